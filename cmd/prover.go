@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"grid-prover/core/prover"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/urfave/cli/v2"
+)
+
+var ProverCmd = &cli.Command{
+	Name:  "prover",
+	Usage: "grid cpu prover node",
+	Subcommands: []*cli.Command{
+		proverNodeRunCmd,
+	},
+}
+
+var proverNodeRunCmd = &cli.Command{
+	Name:  "run",
+	Usage: "run grid cpu prover node",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "validator",
+			Usage: "input validator url, repeat it for each validator of the quorum since every validator challenges with its own rnd",
+			Value: cli.NewStringSlice("http://localhost:8081/v1"),
+		},
+		&cli.StringFlag{
+			Name:     "sk",
+			Usage:    "input provider private key",
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:  "id",
+			Usage: "input node id",
+			Value: 0,
+		},
+		&cli.IntFlag{
+			Name:  "diffcult",
+			Usage: "input pow diffcult, used when the validator does not provide one",
+			Value: 8,
+		},
+		&cli.IntFlag{
+			Name:  "threads",
+			Usage: "input the number of hashing goroutines",
+			Value: runtime.NumCPU(),
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		validatorUrls := ctx.StringSlice("validator")
+		privateKey, err := crypto.HexToECDSA(ctx.String("sk"))
+		if err != nil {
+			return err
+		}
+
+		diffcult := ctx.Int("diffcult")
+		if diffcult < 0 || diffcult >= 256 {
+			return fmt.Errorf("diffcult %d is not in [0, 256)", diffcult)
+		}
+
+		// the validators share the hashing goroutines
+		threads := ctx.Int("threads") / len(validatorUrls)
+		if threads < 1 {
+			threads = 1
+		}
+
+		cctx, cancel := context.WithCancel(ctx.Context)
+		var wg sync.WaitGroup
+		var provers []*prover.GRIDProver
+		for _, validatorUrl := range validatorUrls {
+			prover := prover.NewGRIDProver(validatorUrl, privateKey, ctx.Int("id"), diffcult, threads)
+			provers = append(provers, prover)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				prover.Start(cctx)
+			}()
+		}
+
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		<-quit
+		log.Println("Shutting down prover...")
+
+		cancel()
+		wg.Wait()
+
+		var hashes uint64
+		for _, prover := range provers {
+			hashes += prover.TotalHashes()
+		}
+		log.Printf("Prover exiting, %d hashes computed", hashes)
+
+		return nil
+	},
+}
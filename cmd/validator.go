@@ -2,14 +2,21 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"grid-prover/core"
+	"grid-prover/core/settlement"
 	"grid-prover/core/validator"
+	"grid-prover/core/withdraw"
 	"grid-prover/database"
 	"log"
+	"math/big"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -25,6 +32,38 @@ var ValidatorCmd = &cli.Command{
 	Subcommands: []*cli.Command{
 		// validatorNodeRunCmd,
 		validatorNodeTestCmd,
+		validatorVectorsCmd,
+	},
+}
+
+var validatorVectorsCmd = &cli.Command{
+	Name:  "vectors",
+	Usage: "print withdraw signature test vectors",
+	Flags: []cli.Flag{
+		&cli.Int64Flag{
+			Name:  "chain-id",
+			Usage: "input chain id of the EIP-712 domain",
+			Value: 1,
+		},
+		&cli.StringFlag{
+			Name:  "market",
+			Usage: "input market contract address of the EIP-712 domain",
+			Value: "0x2f196ba4929e1E4aE2623130A1045f877bD1Afca",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		vectors, err := withdraw.Vectors(big.NewInt(ctx.Int64("chain-id")), common.HexToAddress(ctx.String("market")))
+		if err != nil {
+			return err
+		}
+
+		data, err := json.MarshalIndent(vectors, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+
+		return nil
 	},
 }
 
@@ -48,6 +87,46 @@ var validatorNodeTestCmd = &cli.Command{
 			Usage: "input chain name, e.g.(dev)",
 			Value: "dev",
 		},
+		&cli.StringFlag{
+			Name:  "rnd-source",
+			Usage: "input challenge rnd source, e.g.(crypto, commit-reveal, block-hash)",
+			Value: "crypto",
+		},
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "input the path of the validator config file",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "penalty-rate",
+			Usage: "input the part of unreleased profit taken for a missed challenge, overrides the rates of the config",
+			Value: "1/100",
+		},
+		&cli.StringFlag{
+			Name:  "sign-scheme",
+			Usage: "input withdraw signature scheme, e.g.(legacy, packed, eip191, eip712)",
+			Value: string(withdraw.SchemeLegacy),
+		},
+		&cli.Int64Flag{
+			Name:  "chain-id",
+			Usage: "input chain id, required by the eip712 sign scheme",
+			Value: 0,
+		},
+		&cli.DurationFlag{
+			Name:  "shutdown-timeout",
+			Usage: "input how long to wait for the round in flight to settle on shutdown",
+			Value: 2 * time.Minute,
+		},
+		&cli.Uint64Flag{
+			Name:  "confirmations",
+			Usage: "input the number of blocks under the chain head to wait before handling events",
+			Value: 6,
+		},
+		&cli.BoolFlag{
+			Name:  "standby",
+			Usage: "run as active/standby, only the holder of the lease in the database runs the challenges",
+			Value: false,
+		},
 	},
 	Action: func(ctx *cli.Context) error {
 		endPoint := ctx.String("endpoint")
@@ -62,6 +141,18 @@ var validatorNodeTestCmd = &cli.Command{
 			}
 		}
 
+		config, err := validator.LoadConfig(ctx.String("config"))
+		if err != nil {
+			return err
+		}
+		if ctx.IsSet("penalty-rate") {
+			penaltyRate, err := settlement.ParsePenaltyRate(ctx.String("penalty-rate"))
+			if err != nil {
+				return err
+			}
+			config.Penalty.Rates = []settlement.PenaltyRate{penaltyRate}
+		}
+
 		err = database.InitDatabase("~/grid")
 		if err != nil {
 			return err
@@ -73,18 +164,109 @@ var validatorNodeTestCmd = &cli.Command{
 		if err != nil {
 			return err
 		}
+		dumper.SetConfirmations(ctx.Uint64("confirmations"))
+
+		// stops the dumper and the validator on shutdown
+		runCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 
-		err = dumper.DumpGRID()
+		standby := ctx.Bool("standby") || config.Election.Enabled
+		if !standby {
+			err = dumper.DumpGRID(runCtx)
+			if err != nil {
+				return err
+			}
+			go dumper.SubscribeGRID(runCtx)
+		}
+
+		var rndSource validator.RNDSource
+		switch ctx.String("rnd-source") {
+		case "crypto":
+			rndSource = validator.CryptoRND{}
+		case "commit-reveal":
+			rndSource = validator.NewCommitRevealRND()
+		case "block-hash":
+			rndSource = validator.NewBlockHashRND(core.GetEndpointByChain(chain), 2)
+		default:
+			return fmt.Errorf("unknown rnd source %s", ctx.String("rnd-source"))
+		}
+
+		timing := validator.LoadTiming(config.Timing)
+
+		var quorum *validator.Quorum
+		if len(config.Quorum.Peers) > 0 {
+			quorum, err = validator.NewQuorum(config.Quorum)
+			if err != nil {
+				return err
+			}
+		}
+
+		var elector *validator.Elector
+		if standby {
+			leaseName := "validator-" + crypto.PubkeyToAddress(privateKey.PublicKey).Hex()
+			elector, err = validator.NewElector(leaseName, config.Election, timing)
+			if err != nil {
+				return err
+			}
+		}
+
+		validator, err := validator.NewGRIDValidator(chain, privateKey)
 		if err != nil {
 			return err
 		}
-		go dumper.SubscribeGRID(context.TODO())
 
-		validator, err := validator.NewGRIDValidator(chain, privateKey)
+		signer, err := withdraw.NewSigner(withdraw.Scheme(ctx.String("sign-scheme")), big.NewInt(ctx.Int64("chain-id")), marketAddress)
 		if err != nil {
 			return err
 		}
-		go validator.Start(context.TODO())
+		validator.SetWithdrawSigner(signer)
+		validator.SetRNDSource(rndSource)
+
+		err = validator.SetPenaltySchedule(config.Penalty)
+		if err != nil {
+			return err
+		}
+
+		err = validator.SetTiming(timing)
+		if err != nil {
+			return err
+		}
+		log.Printf("challenge timing from %s: prepare %s, prove %s, cycle %s\n", timing.Source, timing.Prepare, timing.Prove, timing.Cycle)
+
+		sampling, err := config.Challenge.Policy()
+		if err != nil {
+			return err
+		}
+		validator.SetSamplingPolicy(sampling)
+		if quorum != nil {
+			validator.SetQuorum(quorum)
+		}
+
+		elected := make(chan struct{})
+		if elector == nil {
+			close(elected)
+			go validator.Start(runCtx)
+		} else {
+			// the standby serves the read-only endpoints until it holds the lease
+			validator.SetActive(false)
+			log.Printf("run as %s, wait for the lease\n", elector.Holder())
+			go func() {
+				defer close(elected)
+				elector.Run(runCtx, func(ctx context.Context) {
+					validator.SetActive(true)
+					defer validator.SetActive(false)
+
+					var wg sync.WaitGroup
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						dumper.SubscribeGRID(ctx)
+					}()
+					validator.Start(ctx)
+					wg.Wait()
+				})
+			}()
+		}
 
 		server, err := NewValidatorServer(validator, endPoint)
 		if err != nil {
@@ -102,11 +284,23 @@ var validatorNodeTestCmd = &cli.Command{
 		<-quit
 		log.Println("Shutting down server...")
 
-		if err := server.Shutdown(context.TODO()); err != nil {
+		// settle the round in flight while the proofs can still be submitted
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), ctx.Duration("shutdown-timeout"))
+		defer stopCancel()
+		err = validator.Stop(stopCtx)
+		if err != nil {
+			log.Println("Round in flight is not settled: ", err)
+		}
+		cancel()
+		// release the lease so that a standby takes over at once
+		<-elected
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer shutdownCancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
 			log.Fatal("Server forced to shutdown: ", err)
 		}
 
-		validator.Stop()
 		log.Println("Server exiting")
 
 		return nil
@@ -3,12 +3,16 @@ package client
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"grid-prover/core/types"
 	"io"
+	"math/big"
 	"net/http"
 
+	"github.com/ethereum/go-ethereum/crypto"
 	"golang.org/x/xerrors"
 )
 
@@ -23,44 +27,165 @@ func NewGRIDClient(url string) *GRIDClient {
 }
 
 type rndResult struct {
-	Rnd string
+	Round int64
+	Rnd   string
 }
 
 func (c *GRIDClient) GetRND(ctx context.Context) ([32]byte, error) {
+	_, rnd, err := c.GetRoundRND(ctx)
+	return rnd, err
+}
+
+// GetRoundRND returns the current round and its rnd
+func (c *GRIDClient) GetRoundRND(ctx context.Context) (int64, [32]byte, error) {
 	var url = c.baseUrl + "/rnd"
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return [32]byte{}, err
+		return 0, [32]byte{}, err
 	}
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return [32]byte{}, err
+		return 0, [32]byte{}, err
 	}
 
 	if res.StatusCode != http.StatusOK {
-		return [32]byte{}, xerrors.Errorf("Failed to get rnd, status [%d]", res.StatusCode)
+		return 0, [32]byte{}, xerrors.Errorf("Failed to get rnd, status [%d]", res.StatusCode)
 	}
 	body, err := io.ReadAll(res.Body)
 	defer res.Body.Close()
 	if err != nil {
-		return [32]byte{}, err
+		return 0, [32]byte{}, err
 	}
 
 	var rndRes rndResult
 	err = json.Unmarshal(body, &rndRes)
 	if err != nil {
-		return [32]byte{}, err
+		return 0, [32]byte{}, err
 	}
 
 	rndBytes, err := hex.DecodeString(rndRes.Rnd)
 	if err != nil {
-		return [32]byte{}, err
+		return 0, [32]byte{}, err
 	}
 
 	var rnd [32]byte
 	copy(rnd[:], rndBytes)
-	return rnd, nil
+	return rndRes.Round, rnd, nil
+}
+
+type difficultyResult struct {
+	Difficulty int
+}
+
+func (c *GRIDClient) GetDifficulty(ctx context.Context, nodeID types.NodeID) (int, error) {
+	var url = fmt.Sprintf("%s/difficulty?address=%s&id=%d", c.baseUrl, nodeID.Address, nodeID.ID)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return 0, xerrors.Errorf("Failed to get difficulty, status [%d]", res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	defer res.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	var difficultyRes difficultyResult
+	err = json.Unmarshal(body, &difficultyRes)
+	if err != nil {
+		return 0, err
+	}
+
+	return difficultyRes.Difficulty, nil
+}
+
+// GetRoundResult returns the signed result of the round seen by the validator
+func (c *GRIDClient) GetRoundResult(ctx context.Context, round int64) (types.RoundResult, error) {
+	var url = fmt.Sprintf("%s/quorum/results/%d", c.baseUrl, round)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return types.RoundResult{}, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return types.RoundResult{}, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return types.RoundResult{}, xerrors.Errorf("Failed to get result of round %d, status [%d]", round, res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	defer res.Body.Close()
+	if err != nil {
+		return types.RoundResult{}, err
+	}
+
+	var result types.RoundResult
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return types.RoundResult{}, err
+	}
+
+	return result, nil
+}
+
+// Settings is the challenge timing of the validator in seconds
+type Settings struct {
+	Prepare int64
+	Prove   int64
+	Cycle   int64
+	Source  string
+	Active  bool
+}
+
+func (c *GRIDClient) GetSettings(ctx context.Context) (Settings, error) {
+	var url = c.baseUrl + "/settings"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return Settings{}, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Settings{}, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return Settings{}, xerrors.Errorf("Failed to get settings, status [%d]", res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	defer res.Body.Close()
+	if err != nil {
+		return Settings{}, err
+	}
+
+	var settings Settings
+	err = json.Unmarshal(body, &settings)
+	if err != nil {
+		return Settings{}, err
+	}
+
+	return settings, nil
+}
+
+// SubmitSignedProof signs the proof of the round with the key of the provider and submits it
+func (c *GRIDClient) SubmitSignedProof(ctx context.Context, proof types.Proof, rnd [32]byte, sk *ecdsa.PrivateKey) error {
+	err := proof.Sign(rnd, sk)
+	if err != nil {
+		return err
+	}
+
+	return c.SubmitProof(ctx, proof)
 }
 
 func (c *GRIDClient) SubmitProof(ctx context.Context, proof types.Proof) error {
@@ -69,7 +194,9 @@ func (c *GRIDClient) SubmitProof(ctx context.Context, proof types.Proof) error {
 
 	payload["address"] = proof.Address
 	payload["id"] = proof.ID
+	payload["round"] = proof.Round
 	payload["nonce"] = proof.Nonce
+	payload["signature"] = proof.Signature
 	b, err := json.Marshal(payload)
 	if err != nil {
 		return err
@@ -91,3 +218,91 @@ func (c *GRIDClient) SubmitProof(ctx context.Context, proof types.Proof) error {
 
 	return nil
 }
+
+type profitResult struct {
+	Balance *big.Int
+	Nonce   uint64
+}
+
+func (c *GRIDClient) getProfit(ctx context.Context, address string) (profitResult, error) {
+	var url = fmt.Sprintf("%s/profit?address=%s", c.baseUrl, address)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return profitResult{}, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return profitResult{}, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return profitResult{}, xerrors.Errorf("Failed to get profit, status [%d]", res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	defer res.Body.Close()
+	if err != nil {
+		return profitResult{}, err
+	}
+
+	var profitRes profitResult
+	err = json.Unmarshal(body, &profitRes)
+	if err != nil {
+		return profitResult{}, err
+	}
+
+	return profitRes, nil
+}
+
+// GetWithdrawSignature asks the validator to sign a withdraw of amount at the
+// current nonce, the request is authenticated with the key of the provider
+func (c *GRIDClient) GetWithdrawSignature(ctx context.Context, sk *ecdsa.PrivateKey, amount *big.Int) ([]byte, error) {
+	address := crypto.PubkeyToAddress(sk.PublicKey).Hex()
+	profit, err := c.getProfit(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	request := types.WithdrawRequest{
+		Address: address,
+		Amount:  amount,
+		Nonce:   profit.Nonce,
+	}
+	auth, err := crypto.Sign(request.Hash(), sk)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.RequestWithdrawSignature(ctx, address, amount, auth)
+}
+
+// RequestWithdrawSignature asks for a withdraw signature with the auth signed by the provider
+func (c *GRIDClient) RequestWithdrawSignature(ctx context.Context, address string, amount *big.Int, auth []byte) ([]byte, error) {
+	var url = fmt.Sprintf("%s/withdraw/signature?address=%s&amount=%s&signature=%s", c.baseUrl, address, amount.String(), hex.EncodeToString(auth))
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("Failed to get withdraw signature, status [%d]", res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	defer res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var signature string
+	err = json.Unmarshal(body, &signature)
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(signature)
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"gorm.io/gorm"
 )
 
 var (
@@ -20,19 +21,27 @@ var (
 	logger = logs.Logger("dumper")
 )
 
+const (
+	// only blocks this deep under the chain head are ingested
+	defaultConfirmations uint64 = 6
+	// processed blocks kept for reorg detection
+	keepBlocks uint64 = 1024
+)
+
 type Dumper struct {
 	endpoint        string
 	contractABI     []abi.ABI
 	contractAddress []common.Address
 	// store           MapStore
 
-	blockNumber *big.Int
+	blockNumber   *big.Int
+	confirmations uint64
 
 	eventNameMap map[common.Hash]string
 	indexedMap   map[common.Hash]abi.Arguments
 }
 
-func getEndpointByChain(chain string) string {
+func GetEndpointByChain(chain string) string {
 	switch chain {
 	case "dev":
 		return "https://devchain.metamemo.one:8501"
@@ -49,9 +58,10 @@ func getEndpointByChain(chain string) string {
 func NewGRIDDumper(chain string, registerAddress, marketAddress common.Address) (dumper *Dumper, err error) {
 	dumper = &Dumper{
 		// store:        store,
-		endpoint:     getEndpointByChain(chain),
-		eventNameMap: make(map[common.Hash]string),
-		indexedMap:   make(map[common.Hash]abi.Arguments),
+		endpoint:      GetEndpointByChain(chain),
+		confirmations: defaultConfirmations,
+		eventNameMap:  make(map[common.Hash]string),
+		indexedMap:    make(map[common.Hash]abi.Arguments),
 	}
 
 	dumper.contractAddress = []common.Address{registerAddress, marketAddress}
@@ -81,18 +91,25 @@ func NewGRIDDumper(chain string, registerAddress, marketAddress common.Address)
 		}
 	}
 
+	dumper.loadBlockNumber()
+
+	return dumper, nil
+}
+
+// loadBlockNumber continues from the block number stored in the database
+func (d *Dumper) loadBlockNumber() {
 	blockNumber, err := database.GetBlockNumber()
 	if err != nil {
 		blockNumber = 0
 	}
-	dumper.blockNumber = big.NewInt(blockNumber)
-
-	return dumper, nil
+	d.blockNumber = big.NewInt(blockNumber)
 }
 
 func (d *Dumper) SubscribeGRID(ctx context.Context) {
+	// another validator may have dumped the events while this one was standby
+	d.loadBlockNumber()
 	for {
-		d.DumpGRID()
+		d.DumpGRID(ctx)
 
 		select {
 		case <-ctx.Done():
@@ -102,16 +119,40 @@ func (d *Dumper) SubscribeGRID(ctx context.Context) {
 	}
 }
 
-func (d *Dumper) DumpGRID() error {
-	client, err := ethclient.DialContext(context.TODO(), d.endpoint)
+// SetConfirmations sets how many blocks under the chain head are considered final
+func (d *Dumper) SetConfirmations(confirmations uint64) {
+	d.confirmations = confirmations
+}
+
+// DumpGRID handles the events up to the safe block, it stops between events
+// when ctx is done
+func (d *Dumper) DumpGRID(ctx context.Context) error {
+	client, err := ethclient.DialContext(ctx, d.endpoint)
 	if err != nil {
 		logger.Error(err.Error())
 		return err
 	}
 	defer client.Close()
 
-	events, err := client.FilterLogs(context.TODO(), ethereum.FilterQuery{
+	err = d.checkReorg(ctx, client)
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	head, err := client.BlockNumber(ctx)
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	if head < d.confirmations || head-d.confirmations < d.blockNumber.Uint64() {
+		return nil
+	}
+	safeBlockNumber := head - d.confirmations
+
+	events, err := client.FilterLogs(ctx, ethereum.FilterQuery{
 		FromBlock: d.blockNumber,
+		ToBlock:   new(big.Int).SetUint64(safeBlockNumber),
 		Addresses: d.contractAddress,
 	})
 	if err != nil {
@@ -121,6 +162,13 @@ func (d *Dumper) DumpGRID() error {
 	lastBlockNumber := d.blockNumber
 
 	for _, event := range events {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			// the rest of the block is handled next time
+			d.blockNumber = new(big.Int).SetUint64(event.BlockNumber)
+			break
+		}
+
 		eventName, ok1 := d.eventNameMap[event.Topics[0]]
 		if !ok1 {
 			continue
@@ -137,10 +185,22 @@ func (d *Dumper) DumpGRID() error {
 			err = d.HandleCreateOrder(event)
 		case "Withdraw":
 			logger.Info("Handle Withdraw Event")
-			err = d.HandleCreateOrder(event)
+			err = d.HandleWithdraw(event)
 		default:
 			continue
 		}
+		if err != nil {
+			logger.Error(err.Error())
+			// replay the whole block next time, the handled events are skipped
+			d.blockNumber = new(big.Int).SetUint64(event.BlockNumber)
+			break
+		}
+
+		block := database.ChainBlock{
+			Number: event.BlockNumber,
+			Hash:   event.BlockHash.Hex(),
+		}
+		err = block.SaveChainBlock()
 		if err != nil {
 			logger.Error(err.Error())
 			break
@@ -152,10 +212,94 @@ func (d *Dumper) DumpGRID() error {
 		}
 	}
 
+	if err == nil {
+		// all events until the safe block are handled
+		var header *types.Header
+		header, err = client.HeaderByNumber(ctx, new(big.Int).SetUint64(safeBlockNumber))
+		if err != nil {
+			logger.Error(err.Error())
+		} else {
+			block := database.ChainBlock{
+				Number:     safeBlockNumber,
+				Hash:       header.Hash().Hex(),
+				ParentHash: header.ParentHash.Hex(),
+			}
+			err = block.SaveChainBlock()
+			if err != nil {
+				logger.Error(err.Error())
+			} else {
+				d.blockNumber = new(big.Int).SetUint64(safeBlockNumber + 1)
+			}
+		}
+	}
+
 	if d.blockNumber.Cmp(lastBlockNumber) == 1 {
 		database.SetBlockNumber(d.blockNumber.Int64())
+		if d.blockNumber.Uint64() > keepBlocks {
+			database.PruneChainBlocks(d.blockNumber.Uint64() - keepBlocks)
+		}
+	}
+
+	// the events handled before the error are kept
+	return err
+}
+
+// headerReader is the part of the chain client used to detect reorgs
+type headerReader interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+// checkReorg compares the stored hash of the last processed block with the
+// chain. On a mismatch it walks back to the newest stored block both agree on
+// and rolls back everything ingested after it. Only the event blocks and the
+// safe blocks are stored, so the fork may be anywhere after that block.
+func (d *Dumper) checkReorg(ctx context.Context, client headerReader) error {
+	if d.blockNumber.Sign() == 0 {
+		return nil
+	}
+
+	last := d.blockNumber.Uint64() - 1
+	parent, err := database.GetChainBlock(last)
+	if err != nil {
+		// nothing recorded for the block, e.g. a database from an older version
+		return nil
+	}
+
+	header, err := client.HeaderByNumber(ctx, new(big.Int).SetUint64(last))
+	if err != nil {
+		return err
+	}
+	if header.Hash().Hex() == parent.Hash {
+		return nil
+	}
+
+	blocks, err := database.ListChainBlocks(last)
+	if err != nil {
+		return err
+	}
+
+	// without a matching block the fork is deeper than the stored blocks,
+	// roll back as far as possible
+	rollback := parent.Number
+	for _, block := range blocks {
+		header, err := client.HeaderByNumber(ctx, new(big.Int).SetUint64(block.Number))
+		if err != nil {
+			return err
+		}
+		if header.Hash().Hex() == block.Hash {
+			rollback = block.Number + 1
+			break
+		}
+		rollback = block.Number
 	}
 
+	logger.Warnf("Reorg detected at block %d, roll back from block %d", last, rollback)
+	err = database.RollbackBlocks(rollback)
+	if err != nil {
+		return err
+	}
+	d.blockNumber = new(big.Int).SetUint64(rollback)
+
 	return nil
 }
 
@@ -177,6 +321,15 @@ func (d *Dumper) unpack(log types.Log, ABI abi.ABI, out interface{}) error {
 	return abi.ParseTopics(out, indexed, log.Topics[1:])
 }
 
+func processedEvent(log types.Log, name string) database.ProcessedEvent {
+	return database.ProcessedEvent{
+		TxHash:      log.TxHash.Hex(),
+		LogIndex:    log.Index,
+		BlockNumber: log.BlockNumber,
+		Name:        name,
+	}
+}
+
 type RegisterEvent struct {
 	Cp     common.Address
 	Name   string
@@ -198,11 +351,8 @@ func (d *Dumper) HandleRegister(log types.Log) error {
 		IP:      out.Ip,
 		Domain:  out.Domain,
 		Port:    out.Port,
-	}
 
-	err = providerInfo.CreateProvider()
-	if err != nil {
-		return err
+		BlockNumber: log.BlockNumber,
 	}
 
 	now := time.Now()
@@ -214,7 +364,26 @@ func (d *Dumper) HandleRegister(log types.Log) error {
 		LastTime: now,
 		EndTime:  now,
 	}
-	return profitInfo.CreateProfit()
+
+	change := database.ProfitChange{
+		BlockNumber: log.BlockNumber,
+		Address:     profitInfo.Address,
+		Created:     true,
+	}
+
+	return database.ProcessEvent(processedEvent(log, "Register"), func(tx *gorm.DB) error {
+		err := providerInfo.CreateProviderTx(tx)
+		if err != nil {
+			return err
+		}
+
+		err = profitInfo.CreateProfitTx(tx)
+		if err != nil {
+			return err
+		}
+
+		return change.CreateProfitChangeTx(tx)
+	})
 }
 
 type AddNodeEvent struct {
@@ -267,17 +436,22 @@ func (d *Dumper) HandleAddNode(log types.Log) error {
 
 		DiskPrice:    out.Disk.DiskPriceSec,
 		DiskCapacity: int64(out.Disk.Num),
+
+		BlockNumber: log.BlockNumber,
 	}
 
-	return nodeInfo.CreateNode()
+	return database.ProcessEvent(processedEvent(log, "AddNode"), func(tx *gorm.DB) error {
+		return nodeInfo.CreateNodeTx(tx)
+	})
 }
 
 type CreateOrderEvent struct {
-	Address    common.Address
-	Id         uint64
-	ActiveTime *big.Int
-	Probation  *big.Int
-	Duration   *big.Int
+	Id  uint64         // 订单id
+	Cp  common.Address // 提供者地址
+	Nid uint64         // 节点id
+	Act *big.Int       // 激活时间
+	Pro *big.Int       // 试用期
+	Dur *big.Int       // 时长
 }
 
 func (d *Dumper) HandleCreateOrder(log types.Log) error {
@@ -287,45 +461,79 @@ func (d *Dumper) HandleCreateOrder(log types.Log) error {
 		return err
 	}
 
-	startTime := out.ActiveTime.Add(out.ActiveTime, out.Probation)
-	endTime := startTime.Add(startTime, out.Duration)
+	startTime := new(big.Int).Add(out.Act, out.Pro)
+	endTime := new(big.Int).Add(startTime, out.Dur)
 	orderInfo := database.Order{
-		Address:      out.Address.Hex(),
-		Id:           int(out.Id),
-		ActivateTime: time.Unix(out.ActiveTime.Int64(), 0),
+		OrderId:      out.Id,
+		Address:      out.Cp.Hex(),
+		Id:           int(out.Nid),
+		ActivateTime: time.Unix(out.Act.Int64(), 0),
 		StartTime:    time.Unix(startTime.Int64(), 0),
 		EndTime:      time.Unix(endTime.Int64(), 0),
-		Probation:    out.Probation.Int64(),
-		Duration:     out.Duration.Int64(),
-	}
+		Probation:    out.Pro.Int64(),
+		Duration:     out.Dur.Int64(),
 
-	err = orderInfo.CreateOrder()
-	if err != nil {
-		return err
+		BlockNumber: log.BlockNumber,
 	}
 
-	nodeInfo, err := database.GetNodeByAddressAndId(orderInfo.Address, orderInfo.Id)
-	if err != nil {
-		return err
-	}
+	return database.ProcessEvent(processedEvent(log, "CreateOrder"), func(tx *gorm.DB) error {
+		err := orderInfo.CreateOrderTx(tx)
+		if err != nil {
+			return err
+		}
 
-	profitInfo, err := database.GetProfitByAddress(orderInfo.Address)
-	if err != nil {
-		return err
-	}
+		nodeInfo, err := database.GetNodeByAddressAndIdTx(tx, orderInfo.Address, orderInfo.Id)
+		if err != nil {
+			return err
+		}
 
-	// (cpuPrice + gpuPrice + memPrice + diskPrice) * duration
-	price := new(big.Int).Add(nodeInfo.CPUPrice, nodeInfo.GPUPrice)
-	price.Add(price, nodeInfo.MemPrice)
-	price.Add(price, nodeInfo.DiskPrice)
-	price.Mul(price, big.NewInt(orderInfo.Duration))
+		profitInfo, err := database.GetProfitByAddressTx(tx, orderInfo.Address)
+		if err != nil {
+			return err
+		}
 
-	profitInfo.Profit.Add(profitInfo.Profit, price)
-	if orderInfo.EndTime.Compare(profitInfo.EndTime) == 1 {
-		profitInfo.EndTime = orderInfo.EndTime
-	}
+		// (cpuPrice + gpuPrice + memPrice + diskPrice) * duration
+		price := nodeInfo.Price()
+		price.Mul(price, big.NewInt(orderInfo.Duration))
+
+		// the profit of the order is released from its start to its end
+		orderProfit := database.OrderProfit{
+			Address:      orderInfo.Address,
+			NodeId:       orderInfo.Id,
+			OrderId:      orderInfo.OrderId,
+			Profit:       new(big.Int).Set(price),
+			Released:     big.NewInt(0),
+			Penalty:      big.NewInt(0),
+			ActivateTime: orderInfo.ActivateTime,
+			StartTime:    orderInfo.StartTime,
+			LastTime:     orderInfo.StartTime,
+			EndTime:      orderInfo.EndTime,
+			BlockNumber:  log.BlockNumber,
+		}
+		err = orderProfit.CreateOrderProfitTx(tx)
+		if err != nil {
+			return err
+		}
+
+		change := database.ProfitChange{
+			BlockNumber: log.BlockNumber,
+			Address:     profitInfo.Address,
+			Profit:      price.String(),
+			EndTime:     profitInfo.EndTime,
+		}
 
-	return profitInfo.UpdateProfit()
+		profitInfo.Profit.Add(profitInfo.Profit, price)
+		if orderInfo.EndTime.Compare(profitInfo.EndTime) == 1 {
+			profitInfo.EndTime = orderInfo.EndTime
+		}
+
+		err = profitInfo.UpdateProfitTx(tx)
+		if err != nil {
+			return err
+		}
+
+		return change.CreateProfitChangeTx(tx)
+	})
 }
 
 type WithdrawEvent struct {
@@ -340,12 +548,30 @@ func (d *Dumper) HandleWithdraw(log types.Log) error {
 		return err
 	}
 
-	profit, err := database.GetProfitByAddress(out.Cp.Hex())
-	if err != nil {
-		return err
-	}
+	return database.ProcessEvent(processedEvent(log, "Withdraw"), func(tx *gorm.DB) error {
+		profit, err := database.GetProfitByAddressTx(tx, out.Cp.Hex())
+		if err != nil {
+			return err
+		}
 
-	profit.Balance.Sub(profit.Balance, out.Amount)
-	profit.Nonce++
-	return profit.UpdateProfit()
+		err = database.CompleteWithdrawalTx(tx, profit.Address, out.Amount, profit.Nonce, log.TxHash.Hex(), log.BlockNumber, time.Now())
+		if err != nil {
+			return err
+		}
+
+		profit.Balance.Sub(profit.Balance, out.Amount)
+		profit.Nonce++
+		err = profit.UpdateProfitTx(tx)
+		if err != nil {
+			return err
+		}
+
+		change := database.ProfitChange{
+			BlockNumber: log.BlockNumber,
+			Address:     profit.Address,
+			Balance:     new(big.Int).Neg(out.Amount).String(),
+			Nonce:       1,
+		}
+		return change.CreateProfitChangeTx(tx)
+	})
 }
@@ -0,0 +1,423 @@
+package core
+
+import (
+	"context"
+	"grid-prover/database"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// the CreateOrder event as emitted by the market contract is stored under the
+// order id of the contract for the node of the event
+func TestHandleCreateOrder(t *testing.T) {
+	err := database.InitDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cp := common.HexToAddress("0x00000000000000000000000000000000000000c1")
+	profit := database.Profit{
+		Address: cp.Hex(),
+		Balance: big.NewInt(0),
+		Profit:  big.NewInt(0),
+		Penalty: big.NewInt(0),
+	}
+	err = profit.CreateProfit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := database.Node{
+		Address:   cp.Hex(),
+		Id:        0,
+		CPUPrice:  big.NewInt(3),
+		GPUPrice:  big.NewInt(0),
+		MemPrice:  big.NewInt(0),
+		DiskPrice: big.NewInt(0),
+	}
+	err = node.CreateNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewGRIDDumper("dev", common.Address{}, common.Address{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := d.contractABI[1].Events["CreateOrder"]
+	data, err := event.Inputs.NonIndexed().Pack(uint64(7), uint64(0), big.NewInt(1000), big.NewInt(10), big.NewInt(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := types.Log{
+		Topics:      []common.Hash{event.ID, common.BytesToHash(cp.Bytes())},
+		Data:        data,
+		BlockNumber: 5,
+		TxHash:      common.HexToHash("0x01"),
+	}
+
+	err = d.HandleCreateOrder(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order database.Order
+	err = database.GlobalDataBase.Where("order_id = ?", 7).First(&order).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Address != cp.Hex() || order.Id != 0 || !order.StartTime.Equal(time.Unix(1010, 0)) || !order.EndTime.Equal(time.Unix(1110, 0)) {
+		t.Errorf("order %+v", order)
+	}
+
+	orderProfits, err := database.ListOrderProfitsByAddressTx(database.GlobalDataBase, cp.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orderProfits) != 1 || orderProfits[0].OrderId != 7 || orderProfits[0].NodeId != 0 || orderProfits[0].Profit.Int64() != 300 {
+		t.Errorf("order profits %+v", orderProfits)
+	}
+}
+
+// testLog packs an event of the contracts, cp is its only indexed input
+func testLog(t *testing.T, event abi.Event, cp common.Address, args ...interface{}) types.Log {
+	t.Helper()
+
+	data, err := event.Inputs.NonIndexed().Pack(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics := []common.Hash{event.ID}
+	for _, input := range event.Inputs {
+		if input.Indexed {
+			topics = append(topics, common.BytesToHash(cp.Bytes()))
+		}
+	}
+
+	return types.Log{
+		Topics: topics,
+		Data:   data,
+	}
+}
+
+// testChain serves the headers of a fake chain by number
+type testChain map[uint64]*types.Header
+
+func newTestChain(n uint64) testChain {
+	chain := testChain{0: {Number: big.NewInt(0)}}
+	for number := uint64(1); number <= n; number++ {
+		chain[number] = &types.Header{Number: new(big.Int).SetUint64(number)}
+	}
+	chain.link(1)
+	return chain
+}
+
+// link points the parent hash of the headers from number on to their parents
+func (c testChain) link(number uint64) {
+	for ; c[number] != nil; number++ {
+		c[number].ParentHash = c[number-1].Hash()
+	}
+}
+
+func (c testChain) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	header, ok := c[number.Uint64()]
+	if !ok {
+		return nil, ethereum.NotFound
+	}
+	return header, nil
+}
+
+type priceTuple struct {
+	PriceMon *big.Int
+	PriceSec *big.Int
+	Model    string
+}
+
+type capacityTuple struct {
+	PriceMon *big.Int
+	PriceSec *big.Int
+	Num      uint64
+}
+
+// a reorg removes the provider, node, order and profit ingested on the
+// orphaned blocks, and takes back what the settlement released from the order
+func TestCheckReorg(t *testing.T) {
+	err := database.InitDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewGRIDDumper("dev", common.Address{}, common.Address{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cpA := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+	cpB := common.HexToAddress("0x00000000000000000000000000000000000000b1")
+	chain := newTestChain(10)
+
+	register := d.contractABI[0].Events["Register"]
+	addNode := d.contractABI[0].Events["AddNode"]
+	createOrder := d.contractABI[1].Events["CreateOrder"]
+	var txs int64
+	handle := func(handler func(types.Log) error, event abi.Event, block uint64, cp common.Address, args ...interface{}) {
+		t.Helper()
+
+		txs++
+		log := testLog(t, event, cp, args...)
+		log.BlockNumber = block
+		log.BlockHash = chain[block].Hash()
+		log.TxHash = common.BigToHash(big.NewInt(txs))
+		err := handler(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := database.ChainBlock{Number: block, Hash: chain[block].Hash().Hex()}
+		err = stored.SaveChainBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	zero := big.NewInt(0)
+	handle(d.HandleRegister, register, 5, cpA, "a", "127.0.0.1", "", "8080")
+	handle(d.HandleRegister, register, 7, cpB, "b", "127.0.0.1", "", "8081")
+	handle(d.HandleAddNode, addNode, 7, cpA, cpA, uint64(0),
+		priceTuple{zero, big.NewInt(3), "cpu"}, priceTuple{zero, zero, ""},
+		capacityTuple{zero, zero, 1}, capacityTuple{zero, zero, 1})
+	handle(d.HandleCreateOrder, createOrder, 7, cpA, uint64(1), uint64(0), big.NewInt(1000), big.NewInt(10), big.NewInt(100))
+	safe := database.ChainBlock{Number: 8, Hash: chain[8].Hash().Hex(), ParentHash: chain[8].ParentHash.Hex()}
+	err = safe.SaveChainBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.blockNumber = big.NewInt(9)
+
+	// the settlement released and penalized a part of the order
+	orderProfits, err := database.ListOrderProfitsByAddressTx(database.GlobalDataBase, cpA.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orderProfits) != 1 {
+		t.Fatalf("order profits %+v", orderProfits)
+	}
+	order := orderProfits[0]
+	order.Profit = big.NewInt(150)
+	order.Released = big.NewInt(100)
+	order.Penalty = big.NewInt(50)
+	err = order.UpdateOrderProfitTx(database.GlobalDataBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = database.AggregateOrderProfitsTx(database.GlobalDataBase, cpA.Hex(), order.Released, time.Unix(1060, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing happens while the chain agrees
+	err = d.checkReorg(context.Background(), chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.blockNumber.Uint64() != 9 {
+		t.Fatalf("rolled back to %d without a reorg", d.blockNumber)
+	}
+
+	chain[6].ParentHash = common.HexToHash("0x06")
+	chain.link(7)
+	err = d.checkReorg(context.Background(), chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.blockNumber.Uint64() != 6 {
+		t.Errorf("rolled back to %d, want 6", d.blockNumber)
+	}
+
+	count := func(model interface{}, query string, args ...interface{}) int64 {
+		t.Helper()
+
+		var n int64
+		err := database.GlobalDataBase.Model(model).Where(query, args...).Count(&n).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	ghosts := []struct {
+		name  string
+		model interface{}
+		query string
+		args  []interface{}
+	}{
+		{"provider", &database.Provider{}, "address = ?", []interface{}{cpB.Hex()}},
+		{"profit", &database.ProfitStore{}, "address = ?", []interface{}{cpB.Hex()}},
+		{"node", &database.NodeStore{}, "address = ?", []interface{}{cpA.Hex()}},
+		{"order", &database.Order{}, "address = ?", []interface{}{cpA.Hex()}},
+		{"order profit", &database.OrderProfitStore{}, "address = ?", []interface{}{cpA.Hex()}},
+		{"chain block", &database.ChainBlock{}, "number >= ?", []interface{}{6}},
+	}
+	for _, ghost := range ghosts {
+		if n := count(ghost.model, ghost.query, ghost.args...); n != 0 {
+			t.Errorf("%d %s rows left", n, ghost.name)
+		}
+	}
+	if n := count(&database.Provider{}, "address = ?", cpA.Hex()); n != 1 {
+		t.Errorf("%d providers registered before the fork", n)
+	}
+
+	profit, err := database.GetProfitByAddress(cpA.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profit.Balance.Sign() != 0 || profit.Profit.Sign() != 0 || profit.Penalty.Sign() != 0 {
+		t.Errorf("balance %s profit %s penalty %s after the rollback", profit.Balance, profit.Profit, profit.Penalty)
+	}
+}
+
+// replaying the events, e.g. after a crash before the block number is saved,
+// changes nothing, the events are told apart by tx hash and log index
+func TestHandleEventsOnce(t *testing.T) {
+	err := database.InitDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewGRIDDumper("dev", common.Address{}, common.Address{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cp := common.HexToAddress("0x00000000000000000000000000000000000000c1")
+	zero := big.NewInt(0)
+	events := []struct {
+		name     string
+		handle   func(types.Log) error
+		log      types.Log
+		txHash   string
+		logIndex uint
+	}{
+		{"register", d.HandleRegister, testLog(t, d.contractABI[0].Events["Register"], cp, "c", "127.0.0.1", "", "8080"), "0x01", 0},
+		{"add node", d.HandleAddNode, testLog(t, d.contractABI[0].Events["AddNode"], cp, cp, uint64(0),
+			priceTuple{zero, big.NewInt(3), "cpu"}, priceTuple{zero, zero, ""},
+			capacityTuple{zero, zero, 1}, capacityTuple{zero, zero, 1}), "0x02", 0},
+		{"create order in the same tx", d.HandleCreateOrder, testLog(t, d.contractABI[1].Events["CreateOrder"], cp, uint64(1), uint64(0), big.NewInt(1000), big.NewInt(10), big.NewInt(100)), "0x02", 1},
+	}
+
+	for replay := 0; replay < 2; replay++ {
+		for _, event := range events {
+			log := event.log
+			log.BlockNumber = 5
+			log.TxHash = common.HexToHash(event.txHash)
+			log.Index = event.logIndex
+			err = event.handle(log)
+			if err != nil {
+				t.Fatalf("%s, replay %d: %v", event.name, replay, err)
+			}
+		}
+	}
+
+	tables := []struct {
+		name  string
+		model interface{}
+		want  int64
+	}{
+		{"processed events", &database.ProcessedEvent{}, 3},
+		{"providers", &database.Provider{}, 1},
+		{"profits", &database.ProfitStore{}, 1},
+		{"profit changes", &database.ProfitChange{}, 2},
+		{"nodes", &database.NodeStore{}, 1},
+		{"orders", &database.Order{}, 1},
+		{"order profits", &database.OrderProfitStore{}, 1},
+	}
+	for _, table := range tables {
+		var n int64
+		err = database.GlobalDataBase.Model(table.model).Count(&n).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != table.want {
+			t.Errorf("%d %s, want %d", n, table.name, table.want)
+		}
+	}
+
+	profit, err := database.GetProfitByAddress(cp.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profit.Profit.Int64() != 300 {
+		t.Errorf("profit %s, want the order counted once", profit.Profit)
+	}
+}
+
+// the Withdraw event of the market contract takes the amount from the balance
+// once and completes the signature issued for it
+func TestHandleWithdraw(t *testing.T) {
+	err := database.InitDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewGRIDDumper("dev", common.Address{}, common.Address{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := d.contractABI[1].Events["Withdraw"]
+	if d.eventNameMap[event.ID] != "Withdraw" {
+		t.Fatalf("Withdraw event is routed to %q", d.eventNameMap[event.ID])
+	}
+
+	cp := common.HexToAddress("0x00000000000000000000000000000000000000c1")
+	profit := database.Profit{
+		Address: cp.Hex(),
+		Balance: big.NewInt(1000),
+		Profit:  big.NewInt(0),
+		Penalty: big.NewInt(0),
+	}
+	err = profit.CreateProfit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withdrawal := database.Withdrawal{
+		Address:   cp.Hex(),
+		Amount:    "600",
+		Signature: "00",
+		Status:    database.WithdrawalPending,
+	}
+	err = withdrawal.CreateWithdrawalTx(database.GlobalDataBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := testLog(t, event, cp, cp, big.NewInt(600))
+	log.BlockNumber = 5
+	log.TxHash = common.HexToHash("0x01")
+	for replay := 0; replay < 2; replay++ {
+		err = d.HandleWithdraw(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	profit, err = database.GetProfitByAddress(cp.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profit.Balance.Int64() != 400 || profit.Nonce != 1 {
+		t.Errorf("balance %s nonce %d after the withdraw", profit.Balance, profit.Nonce)
+	}
+
+	completed, err := database.ListWithdrawalsByAddressTx(database.GlobalDataBase, cp.Hex(), database.WithdrawalCompleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 1 || completed[0].Id != withdrawal.Id || completed[0].TxHash != log.TxHash.Hex() {
+		t.Errorf("completed withdrawals %+v", completed)
+	}
+}
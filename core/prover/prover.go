@@ -0,0 +1,277 @@
+package prover
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"grid-prover/core/client"
+	"grid-prover/core/types"
+	"grid-prover/logs"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/xerrors"
+)
+
+var logger = logs.Logger("grid prover")
+
+// number of nonces a worker takes from the shared counter at once
+const batchSize = 1 << 12
+
+// give the validator some time to generate the rnd of the round
+const rndDelay = time.Second
+
+// how often to ask again while the validator is still on the last round
+const rndRetry = 500 * time.Millisecond
+
+type GRIDProver struct {
+	client *client.GRIDClient
+	nodeID types.NodeID
+	sk     *ecdsa.PrivateKey
+
+	diffcult int
+	threads  int
+
+	prepareInterval time.Duration
+	proveInterval   time.Duration
+	cycleInterval   time.Duration
+
+	hashes   atomic.Uint64
+	hashRate atomic.Uint64
+}
+
+func NewGRIDProver(validatorUrl string, sk *ecdsa.PrivateKey, id int, diffcult int, threads int) *GRIDProver {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+
+	// the validator defaults, replaced by its settings in Start
+	prepareInterval := 10 * time.Second
+	proveInterval := 10 * time.Second
+	return &GRIDProver{
+		client: client.NewGRIDClient(validatorUrl),
+		nodeID: types.NodeID{
+			Address: crypto.PubkeyToAddress(sk.PublicKey).Hex(),
+			ID:      id,
+		},
+		sk: sk,
+
+		diffcult: diffcult,
+		threads:  threads,
+
+		prepareInterval: prepareInterval,
+		proveInterval:   proveInterval,
+		cycleInterval:   2 * time.Minute,
+	}
+}
+
+func (p *GRIDProver) Start(ctx context.Context) {
+	for {
+		p.SyncSettings(ctx)
+
+		// 等待下一个prepare时期
+		start := p.nextCycle(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(start.Add(rndDelay))):
+		}
+
+		err := p.ProveRound(ctx, start)
+		if err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+	}
+}
+
+// SyncSettings aligns the challenge windows with the validator, the current
+// windows are kept if the settings are not available
+func (p *GRIDProver) SyncSettings(ctx context.Context) {
+	settings, err := p.client.GetSettings(ctx)
+	if err != nil {
+		logger.Warnf("Failed to get settings: %s", err.Error())
+		return
+	}
+	if settings.Prepare <= 0 || settings.Prove <= 0 || settings.Cycle < settings.Prepare+settings.Prove {
+		logger.Warnf("Invalid settings: %+v", settings)
+		return
+	}
+
+	p.prepareInterval = time.Duration(settings.Prepare) * time.Second
+	p.proveInterval = time.Duration(settings.Prove) * time.Second
+	p.cycleInterval = time.Duration(settings.Cycle) * time.Second
+}
+
+// ProveRound gets the rnd of the round started at start, searches a nonce and
+// submits it in the prove window of that round
+func (p *GRIDProver) ProveRound(ctx context.Context, start time.Time) error {
+	proveStart := start.Add(p.prepareInterval)
+	proveEnd := proveStart.Add(p.proveInterval)
+
+	ctx, cancel := context.WithDeadline(ctx, proveEnd)
+	defer cancel()
+
+	round, rnd, err := p.roundRND(ctx, p.cycleRound(start))
+	if err != nil {
+		return err
+	}
+
+	// use the difficulty of the validator if it is available
+	diffcult, err := p.client.GetDifficulty(ctx, p.nodeID)
+	if err != nil {
+		logger.Warnf("Failed to get difficulty, use %d: %s", p.diffcult, err.Error())
+	} else if diffcult < 0 || diffcult >= 256 {
+		logger.Warnf("Invalid difficulty %d, use %d", diffcult, p.diffcult)
+	} else {
+		p.diffcult = diffcult
+	}
+
+	nonce, err := p.Search(ctx, round, rnd)
+	if err != nil {
+		return err
+	}
+	logger.Infof("found nonce %d, hash rate %d H/s", nonce, p.HashRate())
+
+	// 等待prove时期
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(proveStart)):
+	}
+
+	proof := types.Proof{
+		NodeID: p.nodeID,
+		Round:  round,
+		Nonce:  nonce,
+	}
+	err = p.client.SubmitSignedProof(ctx, proof, rnd, p.sk)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("submit proof success")
+	return nil
+}
+
+// Search looks for a nonce so that sha256(rnd || proof) has diffcult leading
+// zero bits. The nonce space is split between threads goroutines.
+func (p *GRIDProver) Search(ctx context.Context, round int64, rnd [32]byte) (int64, error) {
+	proof := types.Proof{
+		NodeID: p.nodeID,
+		Round:  round,
+	}
+	// rnd || address || id || round || nonce, only the nonce changes
+	data := append(rnd[:], proof.ToBytes()...)
+	prefixLen := len(data) - 8
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		next   atomic.Int64
+		found  atomic.Bool
+		result int64
+		once   sync.Once
+		wg     sync.WaitGroup
+	)
+
+	begin := time.Now()
+	before := p.hashes.Load()
+	for i := 0; i < p.threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, len(data))
+			copy(buf, data)
+			for !found.Load() {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+
+				end := next.Add(batchSize)
+				for nonce := end - batchSize; nonce < end; nonce++ {
+					binary.LittleEndian.PutUint64(buf[prefixLen:], uint64(nonce))
+					hash := sha256.Sum256(buf)
+					if types.CheckPOWResult(hash[:], p.diffcult) {
+						once.Do(func() {
+							result = nonce
+							found.Store(true)
+							cancel()
+						})
+						p.hashes.Add(uint64(nonce - end + batchSize + 1))
+						return
+					}
+				}
+				p.hashes.Add(batchSize)
+			}
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(begin).Seconds()
+	if elapsed > 0 {
+		p.hashRate.Store(uint64(float64(p.hashes.Load()-before) / elapsed))
+	}
+
+	if !found.Load() {
+		return 0, xerrors.Errorf("Failed to find nonce: %w", ctx.Err())
+	}
+
+	return result, nil
+}
+
+// HashRate returns the hashes per second of the last search
+func (p *GRIDProver) HashRate() uint64 {
+	return p.hashRate.Load()
+}
+
+// TotalHashes returns the number of hashes computed since the prover started
+func (p *GRIDProver) TotalHashes() uint64 {
+	return p.hashes.Load()
+}
+
+// roundRND waits until the validator serves the rnd of round, it may still be
+// preparing the round when the prover asks
+func (p *GRIDProver) roundRND(ctx context.Context, round int64) (int64, [32]byte, error) {
+	for {
+		current, rnd, err := p.client.GetRoundRND(ctx)
+		if err == nil && current == round {
+			return current, rnd, nil
+		}
+		if err == nil && current > round {
+			return 0, [32]byte{}, xerrors.Errorf("validator is at round %d, round %d is over", current, round)
+		}
+
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = xerrors.Errorf("validator is still at round %d", current)
+			}
+			return 0, [32]byte{}, xerrors.Errorf("Failed to get rnd of round %d: %w", round, err)
+		case <-time.After(rndRetry):
+		}
+	}
+}
+
+// cycleRound returns the round started at start, rounds are numbered from the
+// unix epoch
+func (p *GRIDProver) cycleRound(start time.Time) int64 {
+	return start.Unix() / int64(p.cycleInterval.Seconds())
+}
+
+// nextCycle returns the start of the next challenge cycle, rounds are aligned
+// to the unix epoch the same way as the validator
+func (p *GRIDProver) nextCycle(now time.Time) time.Time {
+	cycle := int64(p.cycleInterval.Seconds())
+	over := now.Unix() % cycle
+
+	return time.Unix(now.Unix()-over+cycle, 0)
+}
@@ -0,0 +1,149 @@
+package settlement
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Schedule decides the penalty of a missed challenge from the history of the
+// order. The rate of the n-th consecutive miss is Rates[n-1], the last rate is
+// used for longer streaks.
+//
+// Misses in the probation of the order, from its activation to its start, are
+// not penalized, the user can still cancel the order then. The first Grace of
+// them count in the total misses only, the later ones count in the consecutive
+// misses as well and raise the rate of the misses after the probation.
+type Schedule struct {
+	Grace      int           `json:"grace"`       // 试用期内不计入连续失败的失败次数
+	Rates      []PenaltyRate `json:"rates"`       // 连续失败的惩罚比例
+	Cap        *PenaltyRate  `json:"cap"`         // 单个订单累计惩罚占订单分润的上限, 为空表示不限制
+	SlashAfter int           `json:"slash_after"` // 连续失败n次后罚没全部剩余分润, 0表示不罚没
+	DryRun     bool          `json:"dry_run"`     // 只记录惩罚, 不扣除
+}
+
+func DefaultSchedule(rate PenaltyRate) Schedule {
+	return Schedule{
+		Rates: []PenaltyRate{rate},
+	}
+}
+
+func (s Schedule) Validate() error {
+	if len(s.Rates) == 0 {
+		return xerrors.New("penalty schedule has no rates")
+	}
+	for _, rate := range s.Rates {
+		err := rate.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	if s.Cap != nil {
+		err := s.Cap.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	if s.Grace < 0 || s.SlashAfter < 0 {
+		return xerrors.Errorf("grace %d and slash after %d must not be negative", s.Grace, s.SlashAfter)
+	}
+
+	return nil
+}
+
+// History is the challenge history of an order
+type History struct {
+	Misses      int // 总失败次数
+	Consecutive int // 连续失败次数
+}
+
+func (h History) Next(success bool) History {
+	if success {
+		h.Consecutive = 0
+		return h
+	}
+
+	h.Misses++
+	h.Consecutive++
+	return h
+}
+
+// OrderState is what the schedule needs to know about an order
+type OrderState struct {
+	Account
+	History
+	Activate time.Time // 订单激活时间, 试用期开始
+	Start    time.Time // 订单开始时间, 试用期结束
+	Total    *big.Int  // 订单分润总值
+}
+
+// InProbation reports whether now is in the probation of the order
+func (o OrderState) InProbation(now time.Time) bool {
+	return !now.Before(o.Activate) && now.Before(o.Start)
+}
+
+// Settle settles the order with the result of its node and returns the new
+// history of the order. A slash takes all the remaining profit and is not
+// limited by the cap.
+func (s Schedule) Settle(order OrderState, now time.Time, success bool) (Settlement, History) {
+	history := order.History.Next(success)
+	if success {
+		return Settle(order.Account, now, true, PenaltyRate{}), history
+	}
+
+	if order.InProbation(now) {
+		if history.Misses <= s.Grace {
+			history.Consecutive = order.Consecutive
+		}
+		return Settle(order.Account, now, true, PenaltyRate{}), history
+	}
+
+	if s.SlashAfter > 0 && history.Consecutive >= s.SlashAfter {
+		return Settle(order.Account, now, false, PenaltyRate{Numerator: 1, Denominator: 1}), history
+	}
+
+	res := Settle(order.Account, now, false, s.rate(history.Consecutive))
+	if s.Cap != nil {
+		limit := s.Cap.Apply(order.Total)
+		limit.Sub(limit, order.Penalty)
+		if limit.Sign() < 0 {
+			limit.SetInt64(0)
+		}
+
+		if res.Fine.Cmp(limit) > 0 {
+			over := new(big.Int).Sub(res.Fine, limit)
+			res.Profit.Add(res.Profit, over)
+			res.Penalty.Sub(res.Penalty, over)
+			res.Fine = limit
+		}
+	}
+
+	return res, history
+}
+
+func (s Schedule) rate(consecutive int) PenaltyRate {
+	if consecutive > len(s.Rates) {
+		return s.Rates[len(s.Rates)-1]
+	}
+	return s.Rates[consecutive-1]
+}
+
+func (r PenaltyRate) String() string {
+	return fmt.Sprintf("%d/%d", r.Numerator, r.Denominator)
+}
+
+func (r PenaltyRate) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *PenaltyRate) UnmarshalText(text []byte) error {
+	rate, err := ParsePenaltyRate(string(text))
+	if err != nil {
+		return err
+	}
+
+	*r = rate
+	return nil
+}
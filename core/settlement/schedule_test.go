@@ -0,0 +1,115 @@
+package settlement
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestScheduleSettle(t *testing.T) {
+	// the order is activated at 900 and starts after a probation of 100s
+	start := time.Unix(1000, 0)
+	probation := start.Add(-10 * time.Second)
+	rates := []PenaltyRate{{Numerator: 1, Denominator: 100}, {Numerator: 1, Denominator: 10}, {Numerator: 1, Denominator: 2}}
+	capRate := PenaltyRate{Numerator: 1, Denominator: 20}
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		history  History
+		penalty  int64
+		now      time.Time
+		success  bool
+		reward   int64
+		fine     int64
+		next     History
+	}{
+		{"success", Schedule{Rates: rates}, History{Misses: 3, Consecutive: 2}, 0, start, true, 0, 0, History{Misses: 3}},
+		{"success releases", Schedule{Rates: rates}, History{}, 0, start.Add(100 * time.Second), true, 100, 0, History{}},
+		{"first miss", Schedule{Rates: rates}, History{}, 0, start, false, 0, 10, History{Misses: 1, Consecutive: 1}},
+		{"second miss", Schedule{Rates: rates}, History{Misses: 1, Consecutive: 1}, 0, start, false, 0, 100, History{Misses: 2, Consecutive: 2}},
+		{"third miss", Schedule{Rates: rates}, History{Misses: 2, Consecutive: 2}, 0, start, false, 0, 500, History{Misses: 3, Consecutive: 3}},
+		{"long streak keeps the last rate", Schedule{Rates: rates}, History{Misses: 9, Consecutive: 9}, 0, start, false, 0, 500, History{Misses: 10, Consecutive: 10}},
+		{"miss after a success", Schedule{Rates: rates}, History{Misses: 2}, 0, start, false, 0, 10, History{Misses: 3, Consecutive: 1}},
+		{"miss releases first", Schedule{Rates: rates}, History{}, 0, start.Add(100 * time.Second), false, 100, 9, History{Misses: 1, Consecutive: 1}},
+		{"rate 0", Schedule{Rates: []PenaltyRate{{Numerator: 0, Denominator: 1}}}, History{}, 0, start, false, 0, 0, History{Misses: 1, Consecutive: 1}},
+		{"rate 1/1", Schedule{Rates: []PenaltyRate{{Numerator: 1, Denominator: 1}}}, History{}, 0, start, false, 0, 1000, History{Misses: 1, Consecutive: 1}},
+		{"miss in probation", Schedule{Grace: 2, Rates: rates}, History{}, 0, probation, false, 0, 0, History{Misses: 1}},
+		{"miss in probation within grace", Schedule{Grace: 2, Rates: rates}, History{Misses: 1}, 0, probation, false, 0, 0, History{Misses: 2}},
+		{"miss in probation after grace", Schedule{Grace: 1, Rates: rates}, History{Misses: 1}, 0, probation, false, 0, 0, History{Misses: 2, Consecutive: 1}},
+		{"miss in probation without grace", Schedule{Rates: rates}, History{}, 0, probation, false, 0, 0, History{Misses: 1, Consecutive: 1}},
+		{"success in probation", Schedule{Rates: rates}, History{Misses: 1, Consecutive: 1}, 0, probation, true, 0, 0, History{Misses: 1}},
+		{"miss after probation", Schedule{Grace: 2, Rates: rates}, History{}, 0, start, false, 0, 10, History{Misses: 1, Consecutive: 1}},
+		{"miss after probation misses", Schedule{Grace: 1, Rates: rates}, History{Misses: 2, Consecutive: 1}, 0, start, false, 0, 100, History{Misses: 3, Consecutive: 2}},
+		{"cap", Schedule{Rates: rates, Cap: &capRate}, History{Misses: 1, Consecutive: 1}, 30, start, false, 0, 20, History{Misses: 2, Consecutive: 2}},
+		{"cap not reached", Schedule{Rates: rates, Cap: &capRate}, History{}, 30, start, false, 0, 10, History{Misses: 1, Consecutive: 1}},
+		{"cap reached", Schedule{Rates: rates, Cap: &capRate}, History{}, 60, start, false, 0, 0, History{Misses: 1, Consecutive: 1}},
+		{"slash", Schedule{Rates: rates, SlashAfter: 3}, History{Misses: 2, Consecutive: 2}, 0, start, false, 0, 1000, History{Misses: 3, Consecutive: 3}},
+		{"slash ignores the cap", Schedule{Rates: rates, Cap: &capRate, SlashAfter: 3}, History{Misses: 2, Consecutive: 2}, 30, start, false, 0, 1000, History{Misses: 3, Consecutive: 3}},
+		{"no slash before the streak", Schedule{Rates: rates, SlashAfter: 3}, History{Misses: 5, Consecutive: 1}, 0, start, false, 0, 100, History{Misses: 6, Consecutive: 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.schedule.Validate()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			order := OrderState{
+				Account: Account{
+					Balance:  big.NewInt(0),
+					Profit:   big.NewInt(1000),
+					Penalty:  big.NewInt(tt.penalty),
+					LastTime: start,
+					EndTime:  start.Add(1000 * time.Second),
+				},
+				History:  tt.history,
+				Activate: start.Add(-100 * time.Second),
+				Start:    start,
+				Total:    big.NewInt(1000),
+			}
+
+			res, next := tt.schedule.Settle(order, tt.now, tt.success)
+			if res.Reward.Int64() != tt.reward || res.Fine.Int64() != tt.fine {
+				t.Errorf("reward %s fine %s, want %d %d", res.Reward, res.Fine, tt.reward, tt.fine)
+			}
+			if res.Profit.Int64() != 1000-tt.reward-tt.fine {
+				t.Errorf("profit %s, want %d", res.Profit, 1000-tt.reward-tt.fine)
+			}
+			if res.Penalty.Int64() != tt.penalty+tt.fine {
+				t.Errorf("penalty %s, want %d", res.Penalty, tt.penalty+tt.fine)
+			}
+			if next != tt.next {
+				t.Errorf("history %+v, want %+v", next, tt.next)
+			}
+		})
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	rates := []PenaltyRate{DefaultPenaltyRate}
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		ok       bool
+	}{
+		{"default", DefaultSchedule(DefaultPenaltyRate), true},
+		{"no rates", Schedule{}, false},
+		{"bad rate", Schedule{Rates: []PenaltyRate{{Numerator: 2, Denominator: 1}}}, false},
+		{"bad cap", Schedule{Rates: rates, Cap: &PenaltyRate{Numerator: 1, Denominator: 0}}, false},
+		{"negative grace", Schedule{Rates: rates, Grace: -1}, false},
+		{"negative slash", Schedule{Rates: rates, SlashAfter: -1}, false},
+		{"grace", Schedule{Rates: rates, Grace: 1}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.schedule.Validate()
+			if (err == nil) != tt.ok {
+				t.Errorf("Validate() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package settlement
+
+import (
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// PenaltyRate is the part of the unreleased profit taken for a missed challenge
+type PenaltyRate struct {
+	Numerator   int64
+	Denominator int64
+}
+
+var DefaultPenaltyRate = PenaltyRate{Numerator: 1, Denominator: 100}
+
+// ParsePenaltyRate parses a rate like "1/100"
+func ParsePenaltyRate(s string) (PenaltyRate, error) {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		return PenaltyRate{}, xerrors.Errorf("penalty rate %s is not in the form of a/b", s)
+	}
+
+	numerator, err := strconv.ParseInt(strings.TrimSpace(num), 10, 64)
+	if err != nil {
+		return PenaltyRate{}, err
+	}
+	denominator, err := strconv.ParseInt(strings.TrimSpace(den), 10, 64)
+	if err != nil {
+		return PenaltyRate{}, err
+	}
+
+	rate := PenaltyRate{Numerator: numerator, Denominator: denominator}
+	return rate, rate.Validate()
+}
+
+func (r PenaltyRate) Validate() error {
+	if r.Denominator <= 0 || r.Numerator < 0 || r.Numerator > r.Denominator {
+		return xerrors.Errorf("penalty rate %d/%d is not in [0, 1]", r.Numerator, r.Denominator)
+	}
+	return nil
+}
+
+// Apply returns floor(amount * rate)
+func (r PenaltyRate) Apply(amount *big.Int) *big.Int {
+	penalty := new(big.Int).Mul(amount, big.NewInt(r.Numerator))
+	return penalty.Quo(penalty, big.NewInt(r.Denominator))
+}
+
+// Account is the profit state of a provider
+type Account struct {
+	Balance  *big.Int  // 余额
+	Profit   *big.Int  // 未释放的分润值
+	Penalty  *big.Int  // 累计惩罚值
+	LastTime time.Time // 上次结算时间
+	EndTime  time.Time // 分润值全部释放的时间
+}
+
+type Settlement struct {
+	Account
+	Reward *big.Int // 本次释放到余额的分润值
+	Fine   *big.Int // 本次惩罚值
+}
+
+// Release returns the part of profit released from last to now. The profit
+// is released linearly until end:
+//   - now <= last: nothing
+//   - now >= end: everything
+//   - otherwise: floor(profit * (now - last) / (end - last))
+func Release(profit *big.Int, last, end, now time.Time) *big.Int {
+	if !now.After(last) {
+		return new(big.Int)
+	}
+	if !now.Before(end) {
+		return new(big.Int).Set(profit)
+	}
+
+	// now < end and now > last, so end - last > 0. Count in nanoseconds, last
+	// and end may fall in the same second.
+	reward := new(big.Int).Mul(profit, big.NewInt(int64(now.Sub(last))))
+	return reward.Quo(reward, big.NewInt(int64(end.Sub(last))))
+}
+
+// Settle releases the profit of the account up to now and takes the penalty
+// from what is left if the challenge failed. The account is not modified.
+func Settle(account Account, now time.Time, success bool, rate PenaltyRate) Settlement {
+	reward := Release(account.Profit, account.LastTime, account.EndTime, now)
+	remain := new(big.Int).Sub(account.Profit, reward)
+
+	fine := new(big.Int)
+	if !success {
+		fine = rate.Apply(remain)
+	}
+
+	lastTime := account.LastTime
+	if now.After(lastTime) {
+		lastTime = now
+	}
+
+	return Settlement{
+		Account: Account{
+			Balance:  new(big.Int).Add(account.Balance, reward),
+			Profit:   remain.Sub(remain, fine),
+			Penalty:  new(big.Int).Add(account.Penalty, fine),
+			LastTime: lastTime,
+			EndTime:  account.EndTime,
+		},
+		Reward: reward,
+		Fine:   fine,
+	}
+}
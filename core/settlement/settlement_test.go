@@ -0,0 +1,124 @@
+package settlement
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestRelease(t *testing.T) {
+	last := time.Unix(1000, 0)
+	end := last.Add(100 * time.Second)
+
+	tests := []struct {
+		name string
+		last time.Time
+		end  time.Time
+		now  time.Time
+		want int64
+	}{
+		{"before last", last, end, last.Add(-time.Second), 0},
+		{"at last", last, end, last, 0},
+		{"at end", last, end, end, 1000},
+		{"after end", last, end, end.Add(time.Hour), 1000},
+		{"linear", last, end, last.Add(25 * time.Second), 250},
+		{"linear floor", last, end, last.Add(33 * time.Second), 330},
+		{"linear within a second", last, end, last.Add(1500 * time.Millisecond), 15},
+		{"end in the same second", last, last.Add(800 * time.Millisecond), last.Add(200 * time.Millisecond), 250},
+		{"end before last", last, last.Add(-time.Second), last.Add(time.Second), 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profit := big.NewInt(1000)
+			got := Release(profit, tt.last, tt.end, tt.now)
+			if got.Int64() != tt.want {
+				t.Errorf("Release() = %s, want %d", got, tt.want)
+			}
+			if profit.Int64() != 1000 {
+				t.Errorf("Release() modified the profit: %s", profit)
+			}
+		})
+	}
+}
+
+func TestSettle(t *testing.T) {
+	last := time.Unix(1000, 0)
+	account := Account{
+		Balance:  big.NewInt(50),
+		Profit:   big.NewInt(1000),
+		Penalty:  big.NewInt(5),
+		LastTime: last,
+		EndTime:  last.Add(100 * time.Second),
+	}
+
+	tests := []struct {
+		name    string
+		now     time.Time
+		success bool
+		rate    PenaltyRate
+		reward  int64
+		fine    int64
+		last    time.Time
+	}{
+		{"success", last.Add(10 * time.Second), true, DefaultPenaltyRate, 100, 0, last.Add(10 * time.Second)},
+		{"miss", last.Add(10 * time.Second), false, DefaultPenaltyRate, 100, 9, last.Add(10 * time.Second)},
+		{"miss with rate 0", last.Add(10 * time.Second), false, PenaltyRate{Numerator: 0, Denominator: 1}, 100, 0, last.Add(10 * time.Second)},
+		{"miss with rate 1/1", last.Add(10 * time.Second), false, PenaltyRate{Numerator: 1, Denominator: 1}, 100, 900, last.Add(10 * time.Second)},
+		{"miss before last", last.Add(-time.Second), false, DefaultPenaltyRate, 0, 10, last},
+		{"miss after end", last.Add(time.Hour), false, DefaultPenaltyRate, 1000, 0, last.Add(time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := Settle(account, tt.now, tt.success, tt.rate)
+			if res.Reward.Int64() != tt.reward || res.Fine.Int64() != tt.fine {
+				t.Fatalf("reward %s fine %s, want %d %d", res.Reward, res.Fine, tt.reward, tt.fine)
+			}
+			if res.Balance.Int64() != 50+tt.reward {
+				t.Errorf("balance %s, want %d", res.Balance, 50+tt.reward)
+			}
+			if res.Profit.Int64() != 1000-tt.reward-tt.fine {
+				t.Errorf("profit %s, want %d", res.Profit, 1000-tt.reward-tt.fine)
+			}
+			if res.Penalty.Int64() != 5+tt.fine {
+				t.Errorf("penalty %s, want %d", res.Penalty, 5+tt.fine)
+			}
+			if !res.LastTime.Equal(tt.last) || !res.EndTime.Equal(account.EndTime) {
+				t.Errorf("last %s end %s", res.LastTime, res.EndTime)
+			}
+			if account.Balance.Int64() != 50 || account.Profit.Int64() != 1000 || account.Penalty.Int64() != 5 {
+				t.Errorf("Settle() modified the account")
+			}
+		})
+	}
+}
+
+func TestParsePenaltyRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want PenaltyRate
+		ok   bool
+	}{
+		{"1/100", PenaltyRate{Numerator: 1, Denominator: 100}, true},
+		{" 0 / 1 ", PenaltyRate{Numerator: 0, Denominator: 1}, true},
+		{"1/1", PenaltyRate{Numerator: 1, Denominator: 1}, true},
+		{"2/1", PenaltyRate{}, false},
+		{"-1/2", PenaltyRate{}, false},
+		{"1/0", PenaltyRate{}, false},
+		{"1", PenaltyRate{}, false},
+		{"a/b", PenaltyRate{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParsePenaltyRate(tt.in)
+			if (err == nil) != tt.ok {
+				t.Fatalf("ParsePenaltyRate() error = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && got != tt.want {
+				t.Errorf("ParsePenaltyRate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
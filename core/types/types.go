@@ -1,9 +1,17 @@
 package types
 
 import (
+	"crypto/ecdsa"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"time"
 
+	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 type NodeID struct {
@@ -11,27 +19,172 @@ type NodeID struct {
 	ID      int    `json:"id"`
 }
 
+// ToBytes returns the 20 bytes of the address followed by the id
 func (n *NodeID) ToBytes() []byte {
 	var buf = make([]byte, 8)
 	binary.LittleEndian.PutUint64(buf, uint64(n.ID))
 
-	return append(common.Hex2Bytes(n.Address), buf...)
+	return append(common.HexToAddress(n.Address).Bytes(), buf...)
 }
 
 type Proof struct {
 	NodeID
-	Nonce int64 `json:"nonce"`
+	Round     int64  `json:"round"`
+	Nonce     int64  `json:"nonce"`
+	Signature string `json:"signature,omitempty"` // 节点对证明的签名
 }
 
+// ToBytes returns nodeID || round || nonce, the nonce stays last so that the
+// prefix can be hashed once by the cuda prover
 func (p *Proof) ToBytes() []byte {
+	var roundBuf = make([]byte, 8)
+	binary.LittleEndian.PutUint64(roundBuf, uint64(p.Round))
 	var nonceBuf = make([]byte, 8)
 	binary.LittleEndian.PutUint64(nonceBuf, uint64(p.Nonce))
 	buf := p.NodeID.ToBytes()
+	buf = append(buf, roundBuf...)
 
 	return append(buf, nonceBuf...)
 }
 
+// Hash returns sha256(rnd || proof), the value checked against the difficulty
+func (p *Proof) Hash(rnd [32]byte) []byte {
+	hash := sha256.New()
+	hash.Write(rnd[:])
+	hash.Write(p.ToBytes())
+	return hash.Sum(nil)
+}
+
+// SignHash returns the EIP-191 hash of keccak256(rnd || proof) signed by the provider
+func (p *Proof) SignHash(rnd [32]byte) []byte {
+	return accounts.TextHash(crypto.Keccak256(rnd[:], p.ToBytes()))
+}
+
+func (p *Proof) Sign(rnd [32]byte, sk *ecdsa.PrivateKey) error {
+	signature, err := crypto.Sign(p.SignHash(rnd), sk)
+	if err != nil {
+		return err
+	}
+
+	p.Signature = hex.EncodeToString(signature)
+	return nil
+}
+
+// Signer recovers the address that signed the proof
+func (p *Proof) Signer(rnd [32]byte) (common.Address, error) {
+	signature, err := hex.DecodeString(strings.TrimPrefix(p.Signature, "0x"))
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	publicKey, err := crypto.SigToPub(p.SignHash(rnd), signature)
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	return crypto.PubkeyToAddress(*publicKey), nil
+}
+
 type Result struct {
 	NodeID
-	Success bool
+	Nonce      int64
+	SubmitTime time.Time
+	Success    bool
+}
+
+type NodeResult struct {
+	NodeID
+	Success bool `json:"success"`
+}
+
+// RoundResult is the result of a round seen by a validator, it is signed by
+// the validator and exchanged with the other validators of the quorum
+type RoundResult struct {
+	Round     int64        `json:"round"`
+	Validator string       `json:"validator"`
+	Results   []NodeResult `json:"results"`
+	Signature string       `json:"signature"`
+}
+
+// SignHash returns the EIP-191 hash of keccak256(round || (address || id || success)...),
+// the results must be sorted by address and id
+func (r *RoundResult) SignHash() []byte {
+	var buf = make([]byte, 8, 8+len(r.Results)*29)
+	binary.BigEndian.PutUint64(buf, uint64(r.Round))
+	for _, result := range r.Results {
+		buf = append(buf, common.HexToAddress(result.Address).Bytes()...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(result.ID))
+		if result.Success {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+	}
+
+	return accounts.TextHash(crypto.Keccak256(buf))
+}
+
+func (r *RoundResult) Sign(sk *ecdsa.PrivateKey) error {
+	signature, err := crypto.Sign(r.SignHash(), sk)
+	if err != nil {
+		return err
+	}
+
+	r.Signature = hex.EncodeToString(signature)
+	return nil
+}
+
+// Signer recovers the address that signed the result
+func (r *RoundResult) Signer() (common.Address, error) {
+	signature, err := hex.DecodeString(strings.TrimPrefix(r.Signature, "0x"))
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	publicKey, err := crypto.SigToPub(r.SignHash(), signature)
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	return crypto.PubkeyToAddress(*publicKey), nil
+}
+
+// WithdrawRequest is signed by the provider to ask the validator for a withdraw signature
+type WithdrawRequest struct {
+	Address string
+	Amount  *big.Int
+	Nonce   uint64
+}
+
+// Hash returns the EIP-191 hash of keccak256(address || uint256 amount || uint64 nonce)
+func (w *WithdrawRequest) Hash() []byte {
+	var nonceBuf = make([]byte, 8)
+	binary.BigEndian.PutUint64(nonceBuf, w.Nonce)
+
+	message := crypto.Keccak256(common.HexToAddress(w.Address).Bytes(), common.LeftPadBytes(w.Amount.Bytes(), 32), nonceBuf)
+	return accounts.TextHash(message)
+}
+
+// CheckPOWResult reports whether the first diffcult bits of hash are zero,
+// same as checkOutput in CudaSha256/sha256.cuh. A diffcult out of [0, 256) is
+// never met.
+func CheckPOWResult(hash []byte, diffcult int) bool {
+	if diffcult < 0 || diffcult >= 256 {
+		return false
+	}
+
+	n := diffcult / 8
+	var remain byte = 0xff ^ (0xff >> (diffcult % 8))
+
+	for i := 0; i < n; i++ {
+		if hash[i] != 0 {
+			return false
+		}
+	}
+
+	if hash[n]&remain != 0 {
+		return false
+	}
+
+	return true
 }
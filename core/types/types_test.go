@@ -0,0 +1,62 @@
+package types
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNodeIDToBytes(t *testing.T) {
+	const address = "0x5B38Da6a701c568545dCfcB03FcB875f56beddC4"
+
+	tests := []struct {
+		name string
+		node NodeID
+	}{
+		{"checksummed", NodeID{Address: address, ID: 1}},
+		{"lower case", NodeID{Address: strings.ToLower(address), ID: 1}},
+		{"without prefix", NodeID{Address: address[2:], ID: 1}},
+	}
+
+	want := append([]byte{0x5b, 0x38, 0xda, 0x6a, 0x70, 0x1c, 0x56, 0x85, 0x45, 0xdc, 0xfc, 0xb0, 0x3f, 0xcb, 0x87, 0x5f, 0x56, 0xbe, 0xdd, 0xc4}, 1, 0, 0, 0, 0, 0, 0, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.node.ToBytes()
+			if !bytes.Equal(got, want) {
+				t.Errorf("ToBytes() = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+// the address is part of the hashed proof, a nonce found for one node does
+// not prove the work of another
+func TestProofBindsNode(t *testing.T) {
+	const diffcult = 16
+	rnd := [32]byte{1}
+
+	proof := Proof{
+		NodeID: NodeID{Address: "0x5B38Da6a701c568545dCfcB03FcB875f56beddC4", ID: 0},
+		Round:  3,
+	}
+	for !CheckPOWResult(proof.Hash(rnd), diffcult) {
+		proof.Nonce++
+	}
+
+	tests := []struct {
+		name string
+		node NodeID
+	}{
+		{"other address", NodeID{Address: "0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2", ID: 0}},
+		{"other id", NodeID{Address: proof.Address, ID: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := proof
+			other.NodeID = tt.node
+			if CheckPOWResult(other.Hash(rnd), diffcult) {
+				t.Errorf("nonce %d of %+v is accepted for %+v", proof.Nonce, proof.NodeID, tt.node)
+			}
+		})
+	}
+}
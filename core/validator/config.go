@@ -0,0 +1,79 @@
+package validator
+
+import (
+	"encoding/json"
+	"grid-prover/core/settlement"
+	"os"
+
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/xerrors"
+)
+
+// Config is the config file of the validator, the fields not in the file keep
+// their default values
+type Config struct {
+	Penalty   settlement.Schedule `json:"penalty"`
+	Challenge ChallengeConfig     `json:"challenge"`
+	Timing    TimingConfig        `json:"timing"`
+	Quorum    QuorumConfig        `json:"quorum"`
+	Election  ElectionConfig      `json:"election"`
+}
+
+// ChallengeConfig selects how the challenged nodes of a round are chosen
+type ChallengeConfig struct {
+	Mode   string  `json:"mode"`   // all或sampling
+	Rate   float64 `json:"rate"`   // sampling模式下每轮挑战的节点比例
+	Window int64   `json:"window"` // 每个节点至少每window轮被挑战一次
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Penalty: settlement.DefaultSchedule(settlement.DefaultPenaltyRate),
+		Challenge: ChallengeConfig{
+			Mode:   "all",
+			Rate:   0.1,
+			Window: 30,
+		},
+	}
+}
+
+func (c ChallengeConfig) Policy() (SamplingPolicy, error) {
+	switch c.Mode {
+	case "all":
+		return AllNodes{}, nil
+	case "sampling":
+		return NewWeightedSampling(c.Rate, c.Window)
+	default:
+		return nil, xerrors.Errorf("unknown challenge mode %s", c.Mode)
+	}
+}
+
+// LoadConfig reads the json config at path, an empty path gives the default config
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+	if len(path) == 0 {
+		return config, nil
+	}
+
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return Config{}, err
+	}
+
+	_, err = config.Challenge.Policy()
+	if err != nil {
+		return Config{}, err
+	}
+
+	return config, config.Penalty.Validate()
+}
@@ -0,0 +1,148 @@
+package validator
+
+import (
+	"context"
+	"errors"
+	"grid-prover/core/types"
+	"grid-prover/database"
+	"math"
+	"math/big"
+	"math/bits"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type DifficultyInfo struct {
+	Node  database.Node
+	Price *big.Int // 节点每秒价格
+
+	Current     int           // 当前难度, 0表示还未设置
+	AvgResponse time.Duration // 平均响应时间
+	Responses   int64         // 成功响应次数
+	Answered    bool          // 上一轮是否提交了证明
+}
+
+// DifficultyPolicy calculates the pow difficulty of a node
+type DifficultyPolicy interface {
+	Difficulty(info DifficultyInfo) int
+}
+
+// FixedDifficulty gives every node the same difficulty
+type FixedDifficulty int
+
+func (f FixedDifficulty) Difficulty(info DifficultyInfo) int {
+	return int(f)
+}
+
+// HardwareDifficulty starts from an estimate based on the hardware and price of
+// the node, then moves one bit per round towards the target response time
+type HardwareDifficulty struct {
+	Base   int
+	Min    int
+	Max    int
+	Target time.Duration
+}
+
+func NewHardwareDifficulty(target time.Duration) *HardwareDifficulty {
+	return &HardwareDifficulty{
+		Base:   8,
+		Min:    4,
+		Max:    48,
+		Target: target,
+	}
+}
+
+func (h *HardwareDifficulty) Difficulty(info DifficultyInfo) int {
+	d := info.Current
+	if d == 0 {
+		d = h.Base
+		if info.Node.GPUModel != "" {
+			d += 4
+		}
+		if info.Node.MemCapacity > 0 {
+			d += bits.Len64(uint64(info.Node.MemCapacity)) / 4
+		}
+		if info.Node.DiskCapacity > 0 {
+			d += bits.Len64(uint64(info.Node.DiskCapacity)) / 8
+		}
+		if info.Price != nil {
+			d += info.Price.BitLen() / 16
+		}
+	} else if !info.Answered {
+		d--
+	} else if info.Responses > 0 && info.AvgResponse > 0 {
+		ratio := math.Log2(float64(h.Target) / float64(info.AvgResponse))
+		if ratio >= 1 {
+			d++
+		} else if ratio < 0 {
+			d--
+		}
+	}
+
+	if d < h.Min {
+		d = h.Min
+	}
+	if d > h.Max {
+		d = h.Max
+	}
+	return d
+}
+
+func (v *GRIDValidator) SetDifficultyPolicy(policy DifficultyPolicy) {
+	v.difficulty = policy
+}
+
+// GetDiffcult returns the stored difficulty of the node, the first request of
+// a node calculates it from the hardware record
+func (v *GRIDValidator) GetDiffcult(nodeID types.NodeID) (int, error) {
+	record, err := database.GetNodeDifficultyTx(v.db, nodeID.Address, nodeID.ID)
+	if err == nil && record.Difficulty > 0 {
+		return record.Difficulty, nil
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, err
+	}
+
+	return v.updateDiffcult(nodeID, record, true)
+}
+
+// UpdateDiffcult recalculates the difficulty of the nodes challenged in the last round
+func (v *GRIDValidator) UpdateDiffcult(ctx context.Context, res map[types.NodeID]bool) error {
+	for nodeID, result := range res {
+		record, err := database.GetNodeDifficultyTx(v.db, nodeID.Address, nodeID.ID)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		_, err = v.updateDiffcult(nodeID, record, result)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *GRIDValidator) updateDiffcult(nodeID types.NodeID, record database.NodeDifficulty, answered bool) (int, error) {
+	node, err := database.GetNodeByAddressAndIdTx(v.db, nodeID.Address, nodeID.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	difficulty := v.difficulty.Difficulty(DifficultyInfo{
+		Node:        node,
+		Price:       node.Price(),
+		Current:     record.Difficulty,
+		AvgResponse: time.Duration(record.AvgResponse) * time.Millisecond,
+		Responses:   record.Responses,
+		Answered:    answered,
+	})
+
+	err = database.SetNodeDifficultyTx(v.db, nodeID.Address, nodeID.ID, difficulty)
+	if err != nil {
+		return 0, err
+	}
+
+	return difficulty, nil
+}
@@ -0,0 +1,77 @@
+package validator
+
+import (
+	"context"
+	"grid-prover/core/types"
+	"grid-prover/database"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestHardwareDifficulty(t *testing.T) {
+	target := 4 * time.Second
+
+	tests := []struct {
+		name string
+		info DifficultyInfo
+		want int
+	}{
+		{"new node", DifficultyInfo{}, 8},
+		{"new node with gpu", DifficultyInfo{Node: database.Node{GPUModel: "A100"}}, 12},
+		{"new node with memory", DifficultyInfo{Node: database.Node{MemCapacity: 1 << 34}}, 16},
+		{"new node with disk", DifficultyInfo{Node: database.Node{DiskCapacity: 1 << 40}}, 13},
+		{"new node with price", DifficultyInfo{Price: big.NewInt(1 << 32)}, 10},
+		{"new node over max", DifficultyInfo{Node: database.Node{GPUModel: "A100", MemCapacity: 1 << 62, DiskCapacity: 1 << 62}, Price: new(big.Int).Lsh(big.NewInt(1), 400)}, 48},
+		{"missed", DifficultyInfo{Current: 10}, 9},
+		{"missed at min", DifficultyInfo{Current: 4}, 4},
+		{"fast answers", DifficultyInfo{Current: 10, Answered: true, Responses: 3, AvgResponse: target / 4}, 11},
+		{"fast answers at max", DifficultyInfo{Current: 48, Answered: true, Responses: 3, AvgResponse: target / 4}, 48},
+		{"answers near target", DifficultyInfo{Current: 10, Answered: true, Responses: 3, AvgResponse: target * 2 / 3}, 10},
+		{"slow answers", DifficultyInfo{Current: 10, Answered: true, Responses: 3, AvgResponse: target * 2}, 9},
+		{"answered without record", DifficultyInfo{Current: 10, Answered: true}, 10},
+	}
+
+	policy := NewHardwareDifficulty(target)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := policy.Difficulty(tt.info)
+			if got != tt.want {
+				t.Errorf("Difficulty() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// the difficulty is calculated once for a node and then moved by its results
+func TestDifficultyPersisted(t *testing.T) {
+	now := time.Now()
+	v := newTestValidator(t, NewManualClock(now))
+	v.SetDifficultyPolicy(NewHardwareDifficulty(4 * time.Second))
+	provider := newTestProvider(t, 0)
+	seedOrder(t, v.db, provider.nodeID, 0, now, time.Hour)
+
+	first, err := v.GetDiffcult(provider.nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := v.GetDiffcult(provider.nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Fatalf("difficulty %d, then %d", first, again)
+	}
+
+	err = v.UpdateDiffcult(context.Background(), map[types.NodeID]bool{provider.nodeID: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	missed, err := v.GetDiffcult(provider.nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missed != first-1 {
+		t.Errorf("difficulty %d after a miss, want %d", missed, first-1)
+	}
+}
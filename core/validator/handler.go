@@ -1,35 +1,102 @@
 package validator
 
 import (
-	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"grid-prover/core/types"
 	"grid-prover/database"
+	"grid-prover/logs"
 	"math/big"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/gin-gonic/gin"
+	"golang.org/x/xerrors"
 )
 
 func (v *GRIDValidator) LoadValidatorModule(g *gin.RouterGroup) {
 	g.GET("/rnd", v.GetRNDHandler)
+	g.GET("/rnd/:round", v.GetRoundRNDHandler)
+	g.GET("/settings", v.GetSettingInfo)
+	g.GET("/difficulty", v.GetDifficultyHandler)
+	g.GET("/profit", v.GetProfitInfo)
+	g.GET("/profit/orders", v.ListOrderProfitsHandler)
 	g.GET("/withdraw/signature", v.GetWithdrawSignatureHandler)
+	g.GET("/withdraw/bundle", v.GetWithdrawBundleHandler)
+	g.GET("/withdrawals", v.ListWithdrawalsHandler)
 	g.POST("/proof", v.SubmitProofHandler)
+	g.GET("/rounds", v.ListRoundsHandler)
+	g.GET("/rounds/:round/report", v.GetRoundReportHandler)
+	g.GET("/quorum/results/:round", v.GetRoundResultHandler)
+	g.GET("/nodes/:address/:id/history", v.GetNodeHistoryHandler)
+	g.GET("/nodes/:address/:id/probation", v.GetNodeProbationHandler)
 	fmt.Println("load light node moudle success!")
 }
 
 func (v *GRIDValidator) GetRNDHandler(c *gin.Context) {
+	if !v.checkActive(c) {
+		return
+	}
+
+	round := v.CurrentRound()
 	c.JSON(http.StatusOK, gin.H{
-		"rnd": hex.EncodeToString(RND[:]),
+		"round": round.Round,
+		"rnd":   hex.EncodeToString(round.RND[:]),
 	})
 }
 
-// func GetSettingInfo(c *gin.Context) {
+func (v *GRIDValidator) GetRoundRNDHandler(c *gin.Context) {
+	if !v.checkActive(c) {
+		return
+	}
 
-// }
+	round, err := strconv.ParseInt(c.Param("round"), 10, 64)
+	if err != nil {
+		logger.Error("field round is not a decimal number")
+		c.AbortWithStatusJSON(400, "field round is not a decimal number")
+		return
+	}
+
+	challengeRound, err := database.GetChallengeRoundTx(v.db, round)
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(404, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"round":      challengeRound.Round,
+		"source":     challengeRound.Source,
+		"commitment": challengeRound.Commitment,
+		"rnd":        challengeRound.RND,
+		"reveal":     challengeRound.Reveal,
+	})
+}
+
+// GetSettingInfo returns the challenge timing in seconds, rounds start at
+// multiples of the cycle since the unix epoch
+func (v *GRIDValidator) GetSettingInfo(c *gin.Context) {
+	timing := v.Timing()
+	c.JSON(http.StatusOK, gin.H{
+		"prepare": int64(timing.Prepare.Seconds()),
+		"prove":   int64(timing.Prove.Seconds()),
+		"cycle":   int64(timing.Cycle.Seconds()),
+		"source":  timing.Source,
+		"active":  v.IsActive(),
+	})
+}
 
 func (v *GRIDValidator) SubmitProofHandler(c *gin.Context) {
+	if !v.checkActive(c) {
+		return
+	}
+
+	v.proofLock.RLock()
+	defer v.proofLock.RUnlock()
+
 	var proof types.Proof
 	err := c.BindJSON(&proof)
 	if err != nil {
@@ -38,38 +105,250 @@ func (v *GRIDValidator) SubmitProofHandler(c *gin.Context) {
 		return
 	}
 
-	if !v.IsProveTime() {
+	round := v.CurrentRound()
+	if !round.InProveWindow(v.clock.Now()) {
 		logger.Error("Failure to submit proof within the proof time")
 		c.AbortWithStatusJSON(400, "Failure to submit proof within the proof time")
 		return
 	}
 
-	hash := sha256.New()
-	hash.Write(RND[:])
-	hash.Write(proof.ToBytes())
-	result := hash.Sum(nil)
+	if proof.Round != round.Round {
+		err = logs.RoundError{Message: fmt.Sprintf("proof is for round %d, current round is %d", proof.Round, round.Round)}
+		logger.Error(err)
+		apiErr := logs.ToAPIErrorCode(err)
+		c.AbortWithStatusJSON(apiErr.HTTPStatusCode, apiErr)
+		return
+	}
+
+	nodeID := types.NodeID{
+		Address: common.HexToAddress(proof.Address).Hex(),
+		ID:      proof.ID,
+	}
+	err = v.checkProof(round.Round, nodeID)
+	if err != nil {
+		logger.Error(err)
+		abortWithProofError(c, err)
+		return
+	}
 
-	diffcult, err := getDiffcultByProviderId(proof.NodeID)
+	signer, err := proof.Signer(round.RND)
+	if err != nil {
+		logger.Error(err)
+		c.AbortWithStatusJSON(401, "Failed to recover the signer of proof")
+		return
+	}
+	if signer != common.HexToAddress(proof.Address) {
+		logger.Errorf("Proof of %s is signed by %s", proof.Address, signer.Hex())
+		c.AbortWithStatusJSON(401, "Proof is not signed by the provider")
+		return
+	}
+
+	result := proof.Hash(round.RND)
+
+	diffcult, err := v.GetDiffcult(nodeID)
 	if err != nil {
 		logger.Error(err)
 		c.AbortWithStatusJSON(500, err.Error())
 		return
 	}
 
-	if !checkPOWResult(result, diffcult) {
+	if !types.CheckPOWResult(result, diffcult) {
 		logger.Error("Verify Proof Failed:", hex.EncodeToString(result))
 		c.AbortWithStatusJSON(400, "Verify Proof Failed")
 		return
 	}
 
-	resultChan <- types.Result{
-		NodeID:  proof.NodeID,
-		Success: true,
+	submitTime := v.clock.Now()
+	err = v.acceptProof(round.Round, types.Result{
+		NodeID:     nodeID,
+		Nonce:      proof.Nonce,
+		SubmitTime: submitTime,
+		Success:    true,
+	})
+	if err != nil {
+		logger.Error(err)
+		abortWithProofError(c, err)
+		return
+	}
+
+	// persist the proof so that it survives a restart in the round
+	err = database.SetChallengeResultSuccessTx(v.db, round.Round, nodeID.Address, nodeID.ID, proof.Nonce, submitTime)
+	if err != nil {
+		logger.Error(err)
+	}
+
+	err = database.RecordNodeResponseTx(v.db, nodeID.Address, nodeID.ID, submitTime.Sub(round.Start))
+	if err != nil {
+		logger.Error(err)
 	}
 
 	c.JSON(http.StatusOK, "Verify Proof Success")
 }
 
+func (v *GRIDValidator) GetDifficultyHandler(c *gin.Context) {
+	address := c.Query("address")
+	id := c.Query("id")
+	if len(address) == 0 || len(id) == 0 {
+		logger.Error("field address or id is not set")
+		c.AbortWithStatusJSON(400, "field address or id is not set")
+		return
+	}
+
+	nodeId, err := strconv.Atoi(id)
+	if err != nil {
+		logger.Error("field id is not a decimal number")
+		c.AbortWithStatusJSON(400, "field id is not a decimal number")
+		return
+	}
+
+	nodeID := types.NodeID{
+		Address: common.HexToAddress(address).Hex(),
+		ID:      nodeId,
+	}
+	diffcult, err := v.GetDiffcult(nodeID)
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(400, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"address":    nodeID.Address,
+		"id":         nodeID.ID,
+		"difficulty": diffcult,
+	})
+}
+
+// GetRoundReportHandler returns how the profit of each provider changed in
+// the round and which node results it came from
+func (v *GRIDValidator) GetRoundReportHandler(c *gin.Context) {
+	round, err := strconv.ParseInt(c.Param("round"), 10, 64)
+	if err != nil {
+		logger.Error("field round is not a decimal number")
+		c.AbortWithStatusJSON(400, "field round is not a decimal number")
+		return
+	}
+
+	reports, err := v.RoundReport(round)
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(500, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"round":     round,
+		"providers": reports,
+	})
+}
+
+// GetRoundResultHandler returns the signed result of the round for the other
+// validators of the quorum
+func (v *GRIDValidator) GetRoundResultHandler(c *gin.Context) {
+	round, err := strconv.ParseInt(c.Param("round"), 10, 64)
+	if err != nil {
+		logger.Error("field round is not a decimal number")
+		c.AbortWithStatusJSON(400, "field round is not a decimal number")
+		return
+	}
+
+	result, err := v.RoundResult(round)
+	if err != nil {
+		logger.Error(err.Error())
+		apiErr := logs.ToAPIErrorCode(err)
+		c.AbortWithStatusJSON(apiErr.HTTPStatusCode, apiErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+func (v *GRIDValidator) ListRoundsHandler(c *gin.Context) {
+	page, size, err := getPagination(c)
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(400, err.Error())
+		return
+	}
+
+	rounds, total, err := database.ListChallengeRoundsTx(v.db, (page-1)*size, size)
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(500, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total":  total,
+		"page":   page,
+		"size":   size,
+		"rounds": rounds,
+	})
+}
+
+func (v *GRIDValidator) GetNodeHistoryHandler(c *gin.Context) {
+	address := common.HexToAddress(c.Param("address")).Hex()
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		logger.Error("field id is not a decimal number")
+		c.AbortWithStatusJSON(400, "field id is not a decimal number")
+		return
+	}
+
+	page, size, err := getPagination(c)
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(400, err.Error())
+		return
+	}
+
+	results, total, err := database.ListChallengeResultsByNodeTx(v.db, address, id, (page-1)*size, size)
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(500, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total":   total,
+		"page":    page,
+		"size":    size,
+		"results": results,
+	})
+}
+
+// GetNodeProbationHandler returns the challenges of the node while its orders
+// were in probation, so users can judge the node before probation ends
+func (v *GRIDValidator) GetNodeProbationHandler(c *gin.Context) {
+	address := common.HexToAddress(c.Param("address")).Hex()
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		logger.Error("field id is not a decimal number")
+		c.AbortWithStatusJSON(400, "field id is not a decimal number")
+		return
+	}
+
+	results, err := database.ListProbationResultsByNodeTx(v.db, address, id)
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(500, err.Error())
+		return
+	}
+
+	var success int
+	for _, result := range results {
+		if result.Success {
+			success++
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"challenged": len(results),
+		"success":    success,
+		"results":    results,
+	})
+}
+
 func (v *GRIDValidator) GetProfitInfo(c *gin.Context) {
 	address := c.Query("address")
 	if len(address) == 0 {
@@ -78,7 +357,7 @@ func (v *GRIDValidator) GetProfitInfo(c *gin.Context) {
 		return
 	}
 
-	profit, err := database.GetProfitByAddress("address")
+	profit, err := database.GetProfitByAddressTx(v.db, address)
 	if err != nil {
 		logger.Error(err.Error())
 		c.AbortWithStatusJSON(400, err.Error())
@@ -88,26 +367,41 @@ func (v *GRIDValidator) GetProfitInfo(c *gin.Context) {
 	c.JSON(200, profit)
 }
 
-func (v *GRIDValidator) GetWithdrawSignatureHandler(c *gin.Context) {
+// ListOrderProfitsHandler returns the profit of each order of the provider,
+// the provider profit is the sum of them
+func (v *GRIDValidator) ListOrderProfitsHandler(c *gin.Context) {
 	address := c.Query("address")
-	amount := c.Query("amount")
-	if len(address) == 0 || len(amount) == 0 {
-		logger.Error("field address or amount is not set")
-		c.AbortWithStatusJSON(400, "field address or amount is not set")
+	if len(address) == 0 {
+		logger.Error("field address is not set")
+		c.AbortWithStatusJSON(400, "field address is not set")
 		return
 	}
 
-	amountBig, ok := new(big.Int).SetString(amount, 10)
+	orders, err := database.ListOrderProfitsByAddressTx(v.db, address)
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(400, err.Error())
+		return
+	}
+
+	c.JSON(200, orders)
+}
+
+func (v *GRIDValidator) GetWithdrawSignatureHandler(c *gin.Context) {
+	if !v.checkActive(c) {
+		return
+	}
+
+	address, amountBig, authBytes, ok := parseWithdrawRequest(c)
 	if !ok {
-		logger.Error("field amount is not a decimal number")
-		c.AbortWithStatusJSON(400, "field amount is not a decimal number")
 		return
 	}
 
-	signature, err := v.GenerateWithdrawSignature(address, amountBig)
+	signature, err := v.GenerateWithdrawSignature(address, amountBig, authBytes)
 	if err != nil {
 		logger.Error(err.Error())
-		c.AbortWithStatusJSON(500, err.Error())
+		apiErr := logs.ToAPIErrorCode(err)
+		c.AbortWithStatusJSON(apiErr.HTTPStatusCode, apiErr)
 		return
 	}
 
@@ -115,27 +409,129 @@ func (v *GRIDValidator) GetWithdrawSignatureHandler(c *gin.Context) {
 
 }
 
-func getDiffcultByProviderId(nodeID types.NodeID) (int, error) {
-	return 8, nil
+// GetWithdrawBundleHandler returns the withdraw signatures of the quorum, the
+// request is the same as GetWithdrawSignatureHandler. The deployed Market
+// contract takes one signature only, see GenerateWithdrawBundle for the change
+// it needs to take the bundle.
+func (v *GRIDValidator) GetWithdrawBundleHandler(c *gin.Context) {
+	if !v.checkActive(c) {
+		return
+	}
+
+	address, amountBig, authBytes, ok := parseWithdrawRequest(c)
+	if !ok {
+		return
+	}
+
+	bundle, err := v.GenerateWithdrawBundle(c.Request.Context(), address, amountBig, authBytes)
+	if err != nil {
+		logger.Error(err.Error())
+		apiErr := logs.ToAPIErrorCode(err)
+		c.AbortWithStatusJSON(apiErr.HTTPStatusCode, apiErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"signatures": bundle,
+	})
 }
 
-func checkPOWResult(hash []byte, diffcult int) bool {
-	if diffcult >= 256 {
-		return false
+func (v *GRIDValidator) ListWithdrawalsHandler(c *gin.Context) {
+	address := c.Query("address")
+	if len(address) == 0 {
+		logger.Error("field address is not set")
+		c.AbortWithStatusJSON(400, "field address is not set")
+		return
 	}
 
-	n := diffcult / 8
-	var remain byte = 0xff ^ (0xff >> (diffcult % 8))
+	pending, err := database.ListWithdrawalsByAddressTx(v.db, address, database.WithdrawalPending)
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(500, err.Error())
+		return
+	}
 
-	for i := 0; i < n; i++ {
-		if hash[i] != 0 {
-			return false
-		}
+	completed, err := database.ListWithdrawalsByAddressTx(v.db, address, database.WithdrawalCompleted)
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(500, err.Error())
+		return
 	}
 
-	if hash[n]&remain != 0 {
-		return false
+	c.JSON(http.StatusOK, gin.H{
+		"pending":   pending,
+		"completed": completed,
+	})
+}
+
+// parseWithdrawRequest reads the address, amount and signature fields of a
+// withdraw request, it answers 400 and returns false if one is invalid
+func parseWithdrawRequest(c *gin.Context) (string, *big.Int, []byte, bool) {
+	address := c.Query("address")
+	amount := c.Query("amount")
+	auth := c.Query("signature")
+	if len(address) == 0 || len(amount) == 0 || len(auth) == 0 {
+		logger.Error("field address, amount or signature is not set")
+		c.AbortWithStatusJSON(400, "field address, amount or signature is not set")
+		return "", nil, nil, false
+	}
+
+	amountBig, ok := new(big.Int).SetString(amount, 10)
+	if !ok {
+		logger.Error("field amount is not a decimal number")
+		c.AbortWithStatusJSON(400, "field amount is not a decimal number")
+		return "", nil, nil, false
+	}
+
+	authBytes, err := hex.DecodeString(strings.TrimPrefix(auth, "0x"))
+	if err != nil {
+		logger.Error("field signature is not a hex string")
+		c.AbortWithStatusJSON(400, "field signature is not a hex string")
+		return "", nil, nil, false
+	}
+
+	return address, amountBig, authBytes, true
+}
+
+// checkActive answers 503 when the validator is standby, the rnd, the proofs
+// and the withdraw signatures are only served by the leader
+func (v *GRIDValidator) checkActive(c *gin.Context) bool {
+	if v.IsActive() {
+		return true
+	}
+
+	apiErr := logs.ToAPIErrorCode(logs.StandbyError{Message: "validator is standby"})
+	c.AbortWithStatusJSON(apiErr.HTTPStatusCode, apiErr)
+	return false
+}
+
+// abortWithProofError answers 409 for a node whose proof is already accepted
+// in the round, WrongRound for a round that is over and 400 otherwise
+func abortWithProofError(c *gin.Context, err error) {
+	var conflict logs.ConflictError
+	var round logs.RoundError
+	if errors.As(err, &conflict) || errors.As(err, &round) {
+		apiErr := logs.ToAPIErrorCode(err)
+		c.AbortWithStatusJSON(apiErr.HTTPStatusCode, apiErr)
+		return
+	}
+	c.AbortWithStatusJSON(400, err.Error())
+}
+
+// getPagination parses the page (from 1) and size query fields
+func getPagination(c *gin.Context) (int, int, error) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		return 0, 0, xerrors.Errorf("field page %s is not a positive number", c.Query("page"))
+	}
+
+	size, err := strconv.Atoi(c.DefaultQuery("size", "20"))
+	if err != nil || size < 1 {
+		return 0, 0, xerrors.Errorf("field size %s is not a positive number", c.Query("size"))
+	}
+	if size > 100 {
+		size = 100
 	}
 
-	return true
+	return page, size, nil
 }
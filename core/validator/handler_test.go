@@ -0,0 +1,381 @@
+package validator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"grid-prover/core/types"
+	"grid-prover/database"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getJSON(t *testing.T, url string, out interface{}) int {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK && out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// the node endpoints find the checksummed rows however the address is cased
+func TestNodeHandlersAddressCase(t *testing.T) {
+	v := newTestValidator(t, NewManualClock(time.Now()))
+	provider := newTestProvider(t, 0)
+	address := provider.nodeID.Address
+
+	err := database.SetNodeDifficultyTx(v.db, address, 0, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.CreateChallengeResultsTx(v.db, []database.ChallengeResult{{Round: 1, Address: address, Id: 0, Probation: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		address string
+	}{
+		{"checksummed", address},
+		{"lower case", strings.ToLower(address)},
+		{"upper case", "0x" + strings.ToUpper(address[2:])},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var difficulty struct {
+				Address    string `json:"address"`
+				Difficulty int    `json:"difficulty"`
+			}
+			code := getJSON(t, fmt.Sprintf("%s/difficulty?address=%s&id=0", v.url, tt.address), &difficulty)
+			if code != http.StatusOK || difficulty.Difficulty != 9 || difficulty.Address != address {
+				t.Errorf("difficulty %d %+v", code, difficulty)
+			}
+
+			var history struct {
+				Total int64 `json:"total"`
+			}
+			code = getJSON(t, fmt.Sprintf("%s/nodes/%s/0/history", v.url, tt.address), &history)
+			if code != http.StatusOK || history.Total != 1 {
+				t.Errorf("history %d %+v", code, history)
+			}
+
+			var probation struct {
+				Challenged int `json:"challenged"`
+			}
+			code = getJSON(t, fmt.Sprintf("%s/nodes/%s/0/probation", v.url, tt.address), &probation)
+			if code != http.StatusOK || probation.Challenged != 1 {
+				t.Errorf("probation %d %+v", code, probation)
+			}
+		})
+	}
+}
+
+func TestListWithdrawalsHandler(t *testing.T) {
+	v := newTestValidator(t, NewManualClock(time.Now()))
+	address := newTestProvider(t, 0).nodeID.Address
+
+	withdrawals := []database.Withdrawal{
+		{Address: address, Amount: "100", Nonce: 0, Status: database.WithdrawalCompleted},
+		{Address: address, Amount: "200", Nonce: 1, Status: database.WithdrawalSuperseded},
+		{Address: address, Amount: "300", Nonce: 1, Status: database.WithdrawalCompleted},
+		{Address: address, Amount: "400", Nonce: 2, Status: database.WithdrawalPending},
+		{Address: "0x01", Amount: "500", Nonce: 0, Status: database.WithdrawalPending},
+	}
+	for _, withdrawal := range withdrawals {
+		err := withdrawal.CreateWithdrawalTx(v.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		query     string
+		code      int
+		pending   []string
+		completed []string
+	}{
+		{"provider", "?address=" + address, http.StatusOK, []string{"400"}, []string{"300", "100"}},
+		{"no withdrawals", "?address=0x02", http.StatusOK, nil, nil},
+		{"no address", "", http.StatusBadRequest, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ledger struct {
+				Pending   []database.Withdrawal `json:"pending"`
+				Completed []database.Withdrawal `json:"completed"`
+			}
+			code := getJSON(t, v.url+"/withdrawals"+tt.query, &ledger)
+			if code != tt.code {
+				t.Fatalf("status %d, want %d", code, tt.code)
+			}
+
+			amounts := func(withdrawals []database.Withdrawal) []string {
+				var amounts []string
+				for _, withdrawal := range withdrawals {
+					amounts = append(amounts, withdrawal.Amount)
+				}
+				return amounts
+			}
+			if fmt.Sprint(amounts(ledger.Pending)) != fmt.Sprint(tt.pending) || fmt.Sprint(amounts(ledger.Completed)) != fmt.Sprint(tt.completed) {
+				t.Errorf("pending %v completed %v", amounts(ledger.Pending), amounts(ledger.Completed))
+			}
+		})
+	}
+}
+
+// a node gets one proof accepted per round, a second proof is a conflict and
+// a node that is not challenged is refused
+func TestSubmitProofHandler(t *testing.T) {
+	timing := DefaultTiming()
+	scheduler := NewScheduler(DefaultEpoch, timing, nil)
+	round := scheduler.Round(time.Now()) + 1
+	clock := NewManualClock(scheduler.RoundStart(round).Add(-time.Second))
+
+	v := newTestValidator(t, clock)
+	challenged := newTestProvider(t, 0)
+	unchallenged := newTestProvider(t, 0)
+	seedOrder(t, v.db, challenged.nodeID, 0, clock.Now().Add(-time.Hour), 24*time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	waiting := clock.waiting()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v.Start(ctx)
+	}()
+	eventually(t, "scheduler", func() bool {
+		return clock.waiting() > waiting
+	})
+
+	clock.Advance(scheduler.Event(round, PhasePrepare).At.Sub(clock.Now()))
+	eventually(t, "challenged node", func() bool {
+		return v.checkProof(round, challenged.nodeID) == nil
+	})
+	clock.Advance(timing.Prepare)
+
+	tests := []struct {
+		name     string
+		provider testProvider
+		status   string // 空表示接受
+	}{
+		{"first proof", challenged, ""},
+		{"second proof", challenged, "[409]"},
+		{"unchallenged node", unchallenged, "[400]"},
+	}
+	for _, tt := range tests {
+		err := submitProof(ctx, v.client, tt.provider)
+		if tt.status == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.status != "" && (err == nil || !strings.Contains(err.Error(), tt.status)) {
+			t.Errorf("%s: %v, want status %s", tt.name, err, tt.status)
+		}
+	}
+
+	clock.Advance(timing.Prove)
+	eventually(t, "settlement", func() bool {
+		return roundStatus(v.db, round) == database.RoundSettled
+	})
+	err := v.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	results, err := database.ListChallengeResultsByRoundTx(v.db, round)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !results[0].Success {
+		t.Errorf("results %+v, want the proof of the challenged node", results)
+	}
+}
+
+func TestListRoundsHandler(t *testing.T) {
+	v := newTestValidator(t, NewManualClock(time.Now()))
+	for round := int64(1); round <= 5; round++ {
+		challengeRound := database.ChallengeRound{Round: round, Status: database.RoundSettled}
+		err := challengeRound.CreateChallengeRoundTx(v.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		code   int
+		rounds []int64
+	}{
+		{"default page", "", http.StatusOK, []int64{5, 4, 3, 2, 1}},
+		{"first page", "?page=1&size=2", http.StatusOK, []int64{5, 4}},
+		{"middle page", "?page=2&size=2", http.StatusOK, []int64{3, 2}},
+		{"last page", "?page=3&size=2", http.StatusOK, []int64{1}},
+		{"after the last page", "?page=4&size=2", http.StatusOK, nil},
+		{"page zero", "?page=0", http.StatusBadRequest, nil},
+		{"bad size", "?size=x", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var page struct {
+				Total  int64                     `json:"total"`
+				Rounds []database.ChallengeRound `json:"rounds"`
+			}
+			code := getJSON(t, v.url+"/rounds"+tt.query, &page)
+			if code != tt.code {
+				t.Fatalf("status %d, want %d", code, tt.code)
+			}
+			if code != http.StatusOK {
+				return
+			}
+
+			var rounds []int64
+			for _, round := range page.Rounds {
+				rounds = append(rounds, round.Round)
+			}
+			if page.Total != 5 || fmt.Sprint(rounds) != fmt.Sprint(tt.rounds) {
+				t.Errorf("total %d rounds %v, want %v", page.Total, rounds, tt.rounds)
+			}
+		})
+	}
+}
+
+func TestGetRoundReportHandler(t *testing.T) {
+	now := time.Unix(1_900_000_000, 0)
+	v := newTestValidator(t, NewManualClock(now))
+	provider := newTestProvider(t, 0)
+	seedOrder(t, v.db, provider.nodeID, 1, now.Add(-time.Hour), 24*time.Hour)
+
+	err := v.AddPenalty(context.Background(), 3, now, map[types.NodeID]bool{provider.nodeID: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.CreateChallengeResultsTx(v.db, []database.ChallengeResult{{Round: 3, Address: provider.nodeID.Address, Id: 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		round     string
+		code      int
+		providers int
+	}{
+		{"settled round", "3", http.StatusOK, 1},
+		{"round without results", "4", http.StatusOK, 0},
+		{"bad round", "x", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var report struct {
+				Round     int64            `json:"round"`
+				Providers []ProviderReport `json:"providers"`
+			}
+			code := getJSON(t, fmt.Sprintf("%s/rounds/%s/report", v.url, tt.round), &report)
+			if code != tt.code {
+				t.Fatalf("status %d, want %d", code, tt.code)
+			}
+			if len(report.Providers) != tt.providers {
+				t.Fatalf("report %+v", report)
+			}
+			for _, p := range report.Providers {
+				if p.Address != provider.nodeID.Address || len(p.Nodes) != 1 || p.Nodes[0].Success || p.Penalty == "0" || p.Penalty != p.Nodes[0].Penalty {
+					t.Errorf("provider report %+v", p)
+				}
+			}
+		})
+	}
+}
+
+func TestListOrderProfitsHandler(t *testing.T) {
+	now := time.Unix(1_900_000_000, 0)
+	v := newTestValidator(t, NewManualClock(now))
+	provider := newTestProvider(t, 0)
+	other := types.NodeID{Address: provider.nodeID.Address, ID: 1}
+	seedOrder(t, v.db, provider.nodeID, 1, now.Add(-time.Hour), 24*time.Hour)
+	seedOrder(t, v.db, provider.nodeID, 2, now.Add(-time.Hour), time.Hour)
+	seedOrder(t, v.db, other, 3, now.Add(-time.Hour), 2*time.Hour)
+
+	tests := []struct {
+		name   string
+		query  string
+		code   int
+		orders []string // 节点id-订单id: 分润值
+	}{
+		{"provider", "?address=" + provider.nodeID.Address, http.StatusOK, []string{"0-1: 86400000", "0-2: 3600000", "1-3: 7200000"}},
+		{"unknown provider", "?address=0x01", http.StatusOK, nil},
+		{"no address", "", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var orders []database.OrderProfit
+			code := getJSON(t, v.url+"/profit/orders"+tt.query, &orders)
+			if code != tt.code {
+				t.Fatalf("status %d, want %d", code, tt.code)
+			}
+
+			var got []string
+			for _, order := range orders {
+				got = append(got, fmt.Sprintf("%d-%d: %s", order.NodeId, order.OrderId, order.Profit))
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.orders) {
+				t.Errorf("orders %v, want %v", got, tt.orders)
+			}
+		})
+	}
+}
+
+// a standby does not hand out the rnd, the provers take it from the leader
+func TestStandbyHandlers(t *testing.T) {
+	v := newTestValidator(t, NewManualClock(time.Now()))
+	challengeRound := database.ChallengeRound{Round: 1, Status: database.RoundSettled}
+	err := challengeRound.CreateChallengeRoundTx(v.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		active  int
+		standby int
+	}{
+		{"rnd", "/rnd", http.StatusOK, http.StatusServiceUnavailable},
+		{"rnd of round", "/rnd/1", http.StatusOK, http.StatusServiceUnavailable},
+		{"settings", "/settings", http.StatusOK, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v.SetActive(true)
+			if code := getJSON(t, v.url+tt.path, nil); code != tt.active {
+				t.Errorf("active: status %d, want %d", code, tt.active)
+			}
+			v.SetActive(false)
+			if code := getJSON(t, v.url+tt.path, nil); code != tt.standby {
+				t.Errorf("standby: status %d, want %d", code, tt.standby)
+			}
+		})
+	}
+}
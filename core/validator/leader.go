@@ -0,0 +1,149 @@
+package validator
+
+import (
+	"context"
+	"fmt"
+	"grid-prover/database"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// ElectionConfig enables the active/standby mode, the validators sharing the
+// database elect a leader through a lease
+type ElectionConfig struct {
+	Enabled bool   `json:"enabled"`
+	Holder  string `json:"holder"` // 本进程的标识, 默认为主机名-进程号
+	TTL     int64  `json:"ttl"`    // 租约的秒数, 默认为半个周期
+}
+
+// Elector campaigns for a lease in the shared database. Only the holder of the
+// lease runs the challenge rounds and the chain dumper, the others are standby
+// and take over once the lease expires.
+type Elector struct {
+	name     string
+	holder   string
+	ttl      time.Duration
+	interval time.Duration // 续约和竞选的间隔
+	clock    Clock
+	db       *gorm.DB
+	leader   atomic.Bool
+}
+
+// NewElector creates an elector for the lease name. A standby retries every
+// ttl/3, so the lease of a dead leader is taken over within ttl*4/3, which must
+// not be longer than the cycle.
+func NewElector(name string, config ElectionConfig, timing Timing) (*Elector, error) {
+	holder := config.Holder
+	if len(holder) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		holder = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	ttl := time.Duration(config.TTL) * time.Second
+	if ttl == 0 {
+		ttl = timing.Cycle / 2
+	}
+	if ttl < 3*time.Second || ttl*4/3 > timing.Cycle {
+		return nil, xerrors.Errorf("lease ttl %s is not in [3s, %s]", ttl, timing.Cycle*3/4)
+	}
+
+	return &Elector{
+		name:     name,
+		holder:   holder,
+		ttl:      ttl,
+		interval: ttl / 3,
+		clock:    SystemClock{},
+		db:       database.GlobalDataBase,
+	}, nil
+}
+
+// SetClock replaces the clock of the elector, it must be called before Run
+func (e *Elector) SetClock(clock Clock) {
+	e.clock = clock
+}
+
+// SetDatabase replaces the database holding the lease, it must be called
+// before Run
+func (e *Elector) SetDatabase(db *gorm.DB) {
+	e.db = db
+}
+
+func (e *Elector) Holder() string {
+	return e.holder
+}
+
+func (e *Elector) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Run campaigns until ctx is done. lead is called each time this process
+// becomes leader, its ctx is canceled when the lease is lost. The lease is
+// released when Run returns.
+func (e *Elector) Run(ctx context.Context, lead func(ctx context.Context)) {
+	var cancel context.CancelFunc
+	var led chan struct{}
+	var until time.Time // 持有的租约的过期时间
+
+	stepDown := func() {
+		if cancel == nil {
+			return
+		}
+		cancel()
+		<-led
+		cancel = nil
+		e.leader.Store(false)
+	}
+	defer func() {
+		stepDown()
+		err := database.ReleaseLeaseTx(e.db, e.name, e.holder)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}()
+
+	for {
+		now := e.clock.Now()
+		ok, err := database.AcquireLeaseTx(e.db, e.name, e.holder, now, e.ttl)
+		if err != nil {
+			logger.Error(err.Error())
+			// 续约失败但租约在下次重试前仍有效
+			ok = cancel != nil && now.Add(e.interval).Before(until)
+		} else if ok {
+			until = now.Add(e.ttl)
+		}
+
+		if ok && cancel == nil {
+			logger.Infof("%s becomes the leader of %s", e.holder, e.name)
+			e.leader.Store(true)
+			cancel, led = startLead(ctx, lead)
+		} else if !ok && cancel != nil {
+			logger.Warnf("%s lost the lease of %s, step down", e.holder, e.name)
+			stepDown()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.clock.WaitUntil(now.Add(e.interval)):
+		}
+	}
+}
+
+// startLead runs lead until it returns, led is closed after that
+func startLead(ctx context.Context, lead func(ctx context.Context)) (context.CancelFunc, chan struct{}) {
+	ctx, cancel := context.WithCancel(ctx)
+	led := make(chan struct{})
+	go func() {
+		defer close(led)
+		lead(ctx)
+	}()
+
+	return cancel, led
+}
@@ -0,0 +1,196 @@
+package validator
+
+import (
+	"context"
+	"grid-prover/database"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const testLease = "validator"
+
+type testElector struct {
+	*Elector
+	cancel context.CancelFunc
+	done   chan struct{}
+	leads  atomic.Int32 // lead被调用的次数
+	lost   atomic.Int32 // lead的ctx被取消的次数
+}
+
+func newLeaseDatabase(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := database.OpenDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
+
+// runElector campaigns for the lease in db until its cancel is called, lead
+// counts the terms and blocks until the lease is lost
+func runElector(t *testing.T, holder string, db *gorm.DB, clock Clock) *testElector {
+	t.Helper()
+
+	elector, err := NewElector(testLease, ElectionConfig{Enabled: true, Holder: holder}, DefaultTiming())
+	if err != nil {
+		t.Fatal(err)
+	}
+	elector.SetClock(clock)
+	elector.SetDatabase(db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &testElector{
+		Elector: elector,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(e.done)
+		e.Run(ctx, func(ctx context.Context) {
+			e.leads.Add(1)
+			<-ctx.Done()
+			e.lost.Add(1)
+		})
+	}()
+	t.Cleanup(func() {
+		e.cancel()
+		<-e.done
+	})
+	return e
+}
+
+// tick advances the clock by the interval of the electors and waits for the
+// running ones to campaign again
+func tick(t *testing.T, clock *ManualClock, interval time.Duration, running int) {
+	t.Helper()
+
+	clock.Advance(interval)
+	eventually(t, "electors", func() bool {
+		return clock.waiting() == running
+	})
+}
+
+// two electors on one database, only one leads and it keeps the lease by
+// renewing it within the ttl
+func TestElectorOneLeader(t *testing.T) {
+	db := newLeaseDatabase(t)
+	clock := NewManualClock(time.Unix(1_900_000_000, 0))
+
+	var electors []*testElector
+	for _, holder := range []string{"a", "b"} {
+		electors = append(electors, runElector(t, holder, db, clock))
+	}
+	eventually(t, "electors", func() bool {
+		return clock.waiting() == len(electors)
+	})
+
+	leader := electors[0]
+	if electors[1].IsLeader() {
+		leader = electors[1]
+	}
+	interval := leader.interval
+	for i := 0; i < 10; i++ {
+		leaders := 0
+		for _, e := range electors {
+			if e.IsLeader() {
+				leaders++
+			}
+		}
+		if leaders != 1 || !leader.IsLeader() {
+			t.Fatalf("tick %d: %d leaders", i, leaders)
+		}
+
+		lease, err := database.GetLeaseTx(db, testLease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lease.Holder != leader.Holder() || lease.Expires <= clock.Now().UnixMilli() {
+			t.Fatalf("tick %d: lease %+v is not renewed by %s", i, lease, leader.Holder())
+		}
+
+		tick(t, clock, interval, len(electors))
+	}
+
+	for _, e := range electors {
+		want := int32(0)
+		if e == leader {
+			want = 1
+		}
+		if e.leads.Load() != want || e.lost.Load() != 0 {
+			t.Errorf("%s led %d times and lost the lease %d times", e.Holder(), e.leads.Load(), e.lost.Load())
+		}
+	}
+}
+
+// the lease of a leader that died without releasing it is taken over by the
+// standby once it expires, within one cycle
+func TestElectorTakeover(t *testing.T) {
+	db := newLeaseDatabase(t)
+	timing := DefaultTiming()
+	clock := NewManualClock(time.Unix(1_900_000_000, 0))
+	died := clock.Now()
+
+	standby := runElector(t, "standby", db, clock)
+	ok, err := database.AcquireLeaseTx(db, testLease, "dead", died, standby.ttl)
+	if err != nil || !ok {
+		t.Fatalf("lease of the dead leader: %v %v", ok, err)
+	}
+	eventually(t, "standby", func() bool {
+		return clock.waiting() == 1
+	})
+
+	for !standby.IsLeader() {
+		if clock.Now().Sub(died) > timing.Cycle {
+			t.Fatalf("standby is not the leader %s after the leader died", clock.Now().Sub(died))
+		}
+		tick(t, clock, standby.interval, 1)
+	}
+	if elapsed := clock.Now().Sub(died); elapsed < standby.ttl {
+		t.Errorf("lease taken over %s after the leader died, before it expired", elapsed)
+	}
+	eventually(t, "lead", func() bool {
+		return standby.leads.Load() == 1
+	})
+}
+
+// a leader whose lease is taken cancels lead and steps down
+func TestElectorLosesLease(t *testing.T) {
+	db := newLeaseDatabase(t)
+	clock := NewManualClock(time.Unix(1_900_000_000, 0))
+
+	leader := runElector(t, "leader", db, clock)
+	eventually(t, "lead", func() bool {
+		return clock.waiting() == 1 && leader.leads.Load() == 1
+	})
+
+	// another holder took the lease, e.g. while this process was paused
+	err := db.Model(&database.Lease{}).Where("name = ?", testLease).Updates(map[string]interface{}{
+		"holder":  "other",
+		"expires": clock.Now().Add(time.Hour).UnixMilli(),
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tick(t, clock, leader.interval, 1)
+	if leader.IsLeader() || leader.lost.Load() != 1 {
+		t.Errorf("leader without the lease: leader %v, lost %d", leader.IsLeader(), leader.lost.Load())
+	}
+
+	lease, err := database.GetLeaseTx(db, testLease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Holder != "other" {
+		t.Errorf("lease is held by %s", lease.Holder)
+	}
+}
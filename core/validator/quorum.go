@@ -0,0 +1,298 @@
+package validator
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"grid-prover/core/client"
+	"grid-prover/core/types"
+	"grid-prover/database"
+	"grid-prover/logs"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/xerrors"
+)
+
+// Peer is another validator of the quorum
+type Peer struct {
+	Url     string `json:"url"`     // 例如http://127.0.0.1:8082/v1
+	Address string `json:"address"` // 验证节点的签名地址
+}
+
+type QuorumConfig struct {
+	Peers     []Peer `json:"peers"`
+	Threshold int    `json:"threshold"` // 包括本节点在内, 判定失败和签发取款所需的验证节点数
+	Wait      int64  `json:"wait"`      // 结算时等待其他验证节点结果的秒数
+}
+
+// Quorum lets several validators, each with its own key, agree on the results
+// of a round. A node is penalized only when Threshold validators saw it fail,
+// and a withdraw needs the signatures of Threshold validators. Every validator
+// challenges with its own rnd, so a prover submits to each of them.
+type Quorum struct {
+	peers     []Peer
+	clients   []*client.GRIDClient
+	threshold int
+	wait      time.Duration
+}
+
+func NewQuorum(config QuorumConfig) (*Quorum, error) {
+	if config.Threshold < 1 || config.Threshold > len(config.Peers)+1 {
+		return nil, xerrors.Errorf("quorum threshold %d is not in [1, %d]", config.Threshold, len(config.Peers)+1)
+	}
+
+	q := &Quorum{
+		peers:     config.Peers,
+		threshold: config.Threshold,
+		wait:      time.Duration(config.Wait) * time.Second,
+	}
+	if q.wait <= 0 {
+		q.wait = 5 * time.Second
+	}
+	for _, peer := range config.Peers {
+		if !common.IsHexAddress(peer.Address) {
+			return nil, xerrors.Errorf("address %s of peer %s is invalid", peer.Address, peer.Url)
+		}
+		q.clients = append(q.clients, client.NewGRIDClient(peer.Url))
+	}
+
+	return q, nil
+}
+
+func (v *GRIDValidator) SetQuorum(quorum *Quorum) {
+	v.quorum = quorum
+}
+
+// RoundResult returns the signed result of the round, it is available once the
+// round stops accepting proofs
+func (v *GRIDValidator) RoundResult(round int64) (types.RoundResult, error) {
+	challengeRound, err := database.GetChallengeRoundTx(v.db, round)
+	if err != nil {
+		return types.RoundResult{}, err
+	}
+	if challengeRound.Status != database.RoundClosed && challengeRound.Status != database.RoundSettled {
+		return types.RoundResult{}, logs.RoundError{Message: fmt.Sprintf("round %d is not closed", round)}
+	}
+
+	results, err := database.ListChallengeResultsByRoundTx(v.db, round)
+	if err != nil {
+		return types.RoundResult{}, err
+	}
+
+	res := types.RoundResult{
+		Round:     round,
+		Validator: crypto.PubkeyToAddress(v.sk.PublicKey).Hex(),
+		Results:   make([]types.NodeResult, 0, len(results)),
+	}
+	for _, result := range results {
+		res.Results = append(res.Results, types.NodeResult{
+			NodeID: types.NodeID{
+				Address: result.Address,
+				ID:      result.Id,
+			},
+			Success: result.Success,
+		})
+	}
+
+	return res, res.Sign(v.sk)
+}
+
+// collect fetches the results of the round from the peers, a peer is retried
+// until it answers or the wait is over
+func (q *Quorum) collect(ctx context.Context, round int64) []types.RoundResult {
+	ctx, cancel := context.WithTimeout(ctx, q.wait)
+	defer cancel()
+
+	var (
+		lock    sync.Mutex
+		wg      sync.WaitGroup
+		results []types.RoundResult
+	)
+	for i := range q.peers {
+		wg.Add(1)
+		go func(peer Peer, c *client.GRIDClient) {
+			defer wg.Done()
+
+			for {
+				result, err := c.GetRoundResult(ctx, round)
+				if err == nil {
+					err = verifyRoundResult(result, round, peer)
+				}
+				if err == nil {
+					lock.Lock()
+					results = append(results, result)
+					lock.Unlock()
+					return
+				}
+
+				select {
+				case <-ctx.Done():
+					logger.Warnf("Failed to get result of round %d from %s: %s", round, peer.Url, err.Error())
+					return
+				case <-time.After(time.Second):
+				}
+			}
+		}(q.peers[i], q.clients[i])
+	}
+	wg.Wait()
+
+	return results
+}
+
+func verifyRoundResult(result types.RoundResult, round int64, peer Peer) error {
+	if result.Round != round {
+		return xerrors.Errorf("result is for round %d", result.Round)
+	}
+
+	signer, err := result.Signer()
+	if err != nil {
+		return err
+	}
+	if signer != common.HexToAddress(peer.Address) {
+		return xerrors.Errorf("result is signed by %s", signer.Hex())
+	}
+
+	return nil
+}
+
+// Agree collects the results of the round from the peers and returns the
+// results that the quorum agrees on
+func (q *Quorum) Agree(ctx context.Context, round int64, own map[types.NodeID]bool) map[types.NodeID]bool {
+	peers := q.collect(ctx, round)
+	logger.Infof("got results of round %d from %d of %d peers", round, len(peers), len(q.peers))
+
+	return AggregateResults(own, peers, q.threshold)
+}
+
+// AggregateResults fails a node only when at least threshold validators, this
+// one included, challenged it and got no proof. A validator that did not
+// challenge the node does not vote.
+func AggregateResults(own map[types.NodeID]bool, peers []types.RoundResult, threshold int) map[types.NodeID]bool {
+	failures := make(map[types.NodeID]int, len(own))
+	for nodeID, result := range own {
+		if !result {
+			failures[nodeID]++
+		}
+	}
+	for _, peer := range peers {
+		for _, result := range peer.Results {
+			nodeID := types.NodeID{
+				Address: common.HexToAddress(result.Address).Hex(),
+				ID:      result.ID,
+			}
+			if _, ok := own[nodeID]; ok && !result.Success {
+				failures[nodeID]++
+			}
+		}
+	}
+
+	agreed := make(map[types.NodeID]bool, len(own))
+	for nodeID := range own {
+		agreed[nodeID] = failures[nodeID] < threshold
+	}
+
+	return agreed
+}
+
+type WithdrawSignature struct {
+	Validator string `json:"validator"`
+	Signature string `json:"signature"`
+}
+
+// GenerateWithdrawBundle collects the signatures of the peers for the withdraw
+// and signs it once enough peers did, it fails if less than threshold
+// validators sign. The withdraw is not reserved here when the peers fail, and
+// the peers that signed return the same signature when the request is retried.
+//
+// The Market contract only has withdraw(uint256 amount, bytes sig), checked
+// against its single validator. A bundle can be submitted once the contract
+// takes the signatures of the quorum, e.g. withdraw(uint256 amount, bytes[]
+// sigs) accepting threshold signatures of distinct registered validators over
+// the same hash at the nonce of the provider. Until then only the signature of
+// the validator set in the contract is usable.
+func (v *GRIDValidator) GenerateWithdrawBundle(ctx context.Context, address string, amount *big.Int, auth []byte) ([]WithdrawSignature, error) {
+	own := func() (WithdrawSignature, error) {
+		signature, err := v.GenerateWithdrawSignature(address, amount, auth)
+		if err != nil {
+			return WithdrawSignature{}, err
+		}
+
+		return WithdrawSignature{
+			Validator: crypto.PubkeyToAddress(v.sk.PublicKey).Hex(),
+			Signature: hex.EncodeToString(signature),
+		}, nil
+	}
+
+	if v.quorum == nil {
+		signature, err := own()
+		if err != nil {
+			return nil, err
+		}
+		return []WithdrawSignature{signature}, nil
+	}
+
+	// the nonce is read as GenerateWithdrawSignature reads it
+	v.withdrawLock.Lock()
+	profit, err := database.GetProfitByAddressTx(v.db, address)
+	v.withdrawLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		lock   sync.Mutex
+		wg     sync.WaitGroup
+		bundle []WithdrawSignature
+	)
+	for i, peer := range v.quorum.peers {
+		wg.Add(1)
+		go func(peer Peer, c *client.GRIDClient) {
+			defer wg.Done()
+
+			signature, err := c.RequestWithdrawSignature(ctx, address, amount, auth)
+			if err != nil {
+				logger.Warnf("Failed to get withdraw signature from %s: %s", peer.Url, err.Error())
+				return
+			}
+			if !v.signer.Verify(common.HexToAddress(peer.Address), common.HexToAddress(address), amount, profit.Nonce, signature) {
+				logger.Warnf("Withdraw signature from %s is not signed by %s", peer.Url, peer.Address)
+				return
+			}
+
+			lock.Lock()
+			bundle = append(bundle, WithdrawSignature{
+				Validator: peer.Address,
+				Signature: hex.EncodeToString(signature),
+			})
+			lock.Unlock()
+		}(peer, v.quorum.clients[i])
+	}
+	wg.Wait()
+
+	if len(bundle)+1 < v.quorum.threshold {
+		return nil, xerrors.Errorf("got %d withdraw signatures of peers, %d are required", len(bundle), v.quorum.threshold-1)
+	}
+
+	// a Withdraw event may move the nonce while the peers sign, all the
+	// signatures of a bundle must be of the same nonce
+	v.withdrawLock.Lock()
+	current, err := database.GetProfitByAddressTx(v.db, address)
+	v.withdrawLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if current.Nonce != profit.Nonce {
+		return nil, logs.ConflictError{Message: fmt.Sprintf("nonce of %s moved from %d to %d while the peers signed", address, profit.Nonce, current.Nonce)}
+	}
+
+	signature, err := own()
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]WithdrawSignature{signature}, bundle...), nil
+}
@@ -0,0 +1,277 @@
+package validator
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"grid-prover/core/types"
+	"grid-prover/database"
+	"grid-prover/logs"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"gorm.io/gorm"
+)
+
+func validatorAddress(v *testValidator) string {
+	return crypto.PubkeyToAddress(v.sk.PublicKey).Hex()
+}
+
+// newTestQuorum runs n validators on loopback, the first one has the others as
+// its peers
+func newTestQuorum(t *testing.T, clock Clock, n int, threshold int) []*testValidator {
+	t.Helper()
+
+	var validators []*testValidator
+	for i := 0; i < n; i++ {
+		validators = append(validators, newTestValidator(t, clock))
+	}
+
+	var peers []Peer
+	for _, peer := range validators[1:] {
+		peers = append(peers, Peer{
+			Url:     peer.url,
+			Address: validatorAddress(peer),
+		})
+	}
+	quorum, err := NewQuorum(QuorumConfig{
+		Peers:     peers,
+		Threshold: threshold,
+		Wait:      1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	validators[0].SetQuorum(quorum)
+
+	return validators
+}
+
+func seedBalance(t *testing.T, db *gorm.DB, address string, balance int64) {
+	t.Helper()
+
+	profit := database.Profit{
+		Address: address,
+		Balance: big.NewInt(balance),
+		Profit:  big.NewInt(0),
+		Penalty: big.NewInt(0),
+	}
+	err := profit.CreateProfitTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a bundle that misses peer signatures reserves nothing on this validator, and
+// the retry gets the signatures already issued by the peers
+func TestWithdrawBundleRetry(t *testing.T) {
+	validators := newTestQuorum(t, NewManualClock(time.Now()), 3, 3)
+	provider := newTestProvider(t, 0)
+	address := provider.nodeID.Address
+	seedBalance(t, validators[0].db, address, 1000)
+	seedBalance(t, validators[1].db, address, 1000)
+
+	amount := big.NewInt(600)
+	request := types.WithdrawRequest{
+		Address: address,
+		Amount:  amount,
+	}
+	auth, err := crypto.Sign(request.Hash(), provider.sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last peer does not know the provider yet
+	_, err = validators[0].GenerateWithdrawBundle(context.Background(), address, amount, auth)
+	if err == nil {
+		t.Fatal("bundle without enough peers is issued")
+	}
+	_, err = database.GetPendingWithdrawalTx(validators[0].db, address, 0)
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("failed bundle is reserved: %v", err)
+	}
+	issued, err := database.GetPendingWithdrawalTx(validators[1].db, address, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seedBalance(t, validators[2].db, address, 1000)
+	bundle, err := validators[0].GenerateWithdrawBundle(context.Background(), address, amount, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle) != 3 {
+		t.Fatalf("%d signatures, want 3", len(bundle))
+	}
+	if bundle[0].Validator != validatorAddress(validators[0]) {
+		t.Errorf("first signature is of %s", bundle[0].Validator)
+	}
+	for _, signed := range bundle {
+		signature, err := hex.DecodeString(signed.Signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !validators[0].signer.Verify(common.HexToAddress(signed.Validator), common.HexToAddress(address), amount, 0, signature) {
+			t.Errorf("signature of %s does not verify", signed.Validator)
+		}
+		if signed.Validator == validatorAddress(validators[1]) && signed.Signature != issued.Signature {
+			t.Errorf("retry got a new signature of %s", signed.Validator)
+		}
+	}
+
+	// the nonce stays reserved for the signed amount
+	request.Amount = big.NewInt(500)
+	auth, err = crypto.Sign(request.Hash(), provider.sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = validators[0].GenerateWithdrawSignature(address, request.Amount, auth)
+	var conflict logs.ConflictError
+	if !errors.As(err, &conflict) {
+		t.Errorf("another amount at the same nonce: %v", err)
+	}
+}
+
+// a Withdraw event that moves the nonce while the peers sign fails the bundle
+// instead of mixing the signatures of two nonces
+func TestWithdrawBundleNonceMoved(t *testing.T) {
+	validators := newTestQuorum(t, NewManualClock(time.Now()), 2, 2)
+	provider := newTestProvider(t, 0)
+	address := provider.nodeID.Address
+	seedBalance(t, validators[0].db, address, 1000)
+	seedBalance(t, validators[1].db, address, 1000)
+
+	// the peer signs at nonce 0 while the event arrives on this validator
+	target, err := url.Parse(validators[1].url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: target.Scheme, Host: target.Host})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		profit, err := database.GetProfitByAddressTx(validators[0].db, address)
+		if err == nil {
+			profit.Nonce++
+			err = profit.UpdateProfitTx(validators[0].db)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+		peer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	quorum, err := NewQuorum(QuorumConfig{
+		Peers:     []Peer{{Url: server.URL + "/v1", Address: validatorAddress(validators[1])}},
+		Threshold: 2,
+		Wait:      1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	validators[0].SetQuorum(quorum)
+
+	amount := big.NewInt(600)
+	request := types.WithdrawRequest{
+		Address: address,
+		Amount:  amount,
+	}
+	auth, err := crypto.Sign(request.Hash(), provider.sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = validators[0].GenerateWithdrawBundle(context.Background(), address, amount, auth)
+	var conflict logs.ConflictError
+	if !errors.As(err, &conflict) {
+		t.Errorf("bundle across a moved nonce: %v", err)
+	}
+}
+
+// the validators of a quorum run side by side on loopback, the first one
+// penalizes a node only when enough of them saw it fail
+func TestQuorumLoopback(t *testing.T) {
+	timing := DefaultTiming()
+	scheduler := NewScheduler(DefaultEpoch, timing, nil)
+	round := scheduler.Round(time.Now()) + 1
+	clock := NewManualClock(scheduler.RoundStart(round).Add(-time.Second))
+
+	validators := newTestQuorum(t, clock, 3, 2)
+	validators[0].quorum.wait = 5 * time.Second
+
+	// the first provider proves to all validators, the second one misses the
+	// first validator only and the third one proves to none
+	providers := []testProvider{newTestProvider(t, 0), newTestProvider(t, 0), newTestProvider(t, 0)}
+	proveTo := [][]int{{0, 1, 2}, {1, 2}, {}}
+	for _, v := range validators {
+		for i, provider := range providers {
+			seedOrder(t, v.db, provider.nodeID, uint64(i), clock.Now().Add(-time.Hour), 24*time.Hour)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	waiting := clock.waiting()
+	var running sync.WaitGroup
+	for _, v := range validators {
+		running.Add(1)
+		go func(v *testValidator) {
+			defer running.Done()
+			v.Start(ctx)
+		}(v)
+	}
+	eventually(t, "schedulers", func() bool {
+		return clock.waiting() >= waiting+len(validators)
+	})
+
+	clock.Advance(scheduler.Event(round, PhasePrepare).At.Sub(clock.Now()))
+	for _, v := range validators {
+		for _, provider := range providers {
+			eventually(t, "challenged nodes", func() bool {
+				return !errors.Is(v.checkProof(round, provider.nodeID), ErrNotChallenged) && v.CurrentRound().Round == round
+			})
+		}
+	}
+
+	clock.Advance(timing.Prepare)
+	for i, provider := range providers {
+		for _, j := range proveTo[i] {
+			err := submitProof(ctx, validators[j].client, provider)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	clock.Advance(timing.Prove)
+	for _, v := range validators {
+		eventually(t, "settlement", func() bool {
+			return roundStatus(v.db, round) == database.RoundSettled
+		})
+	}
+
+	for _, v := range validators {
+		err := v.Stop(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	running.Wait()
+
+	for i, provider := range providers {
+		profit, err := database.GetProfitByAddressTx(validators[0].db, provider.nodeID.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		penalized := len(proveTo[i]) == 0
+		if (profit.Penalty.Sign() > 0) != penalized {
+			t.Errorf("provider proving to %v has penalty %s", proveTo[i], profit.Penalty)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package validator
+
+import (
+	"context"
+	"encoding/hex"
+	"grid-prover/core/types"
+	"grid-prover/database"
+
+	"golang.org/x/xerrors"
+)
+
+// recoverRounds handles the rounds the last run left unsettled. The round still
+// in its prepare or prove window is resumed, the others are settled after the
+// fact. It returns the resumed round and the first event to wait for.
+func (v *GRIDValidator) recoverRounds(ctx context.Context) (*challenge, PhaseEvent) {
+	now := v.clock.Now()
+	first := v.scheduler.First(now)
+
+	rounds, err := database.ListUnsettledRoundsTx(v.db)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, first
+	}
+
+	var current *challenge
+	for _, round := range rounds {
+		ch, state, accepted, err := v.loadChallenge(round)
+		if err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+
+		if now.Before(state.ProveEnd) {
+			logger.Infof("resume round %d with %d accepted proofs", round.Round, len(accepted))
+			v.restoreRound(state, ch.resultMap, accepted)
+			current = ch
+			first = v.scheduler.Event(round.Round, PhaseProve)
+			if !now.Before(state.ProveStart) {
+				first = v.scheduler.Event(round.Round, PhaseSettle)
+			}
+			continue
+		}
+
+		// the validator may be down in the prove window, the nodes that did not
+		// get a proof accepted could not submit it, so they are not penalized
+		if round.Status == database.RoundPrepared {
+			ch.skipped = failed(ch.resultMap)
+		}
+
+		logger.Infof("settle round %d after restart", round.Round)
+		v.settleRound(ctx, ch, false)
+	}
+
+	return current, first
+}
+
+// loadChallenge rebuilds a prepared round from the database
+func (v *GRIDValidator) loadChallenge(round database.ChallengeRound) (*challenge, RoundState, []types.Result, error) {
+	rnd, err := hex.DecodeString(round.RND)
+	if err != nil || len(rnd) != 32 {
+		return nil, RoundState{}, nil, xerrors.Errorf("rnd %s of round %d is invalid", round.RND, round.Round)
+	}
+	reveal, err := hex.DecodeString(round.Reveal)
+	if err != nil {
+		return nil, RoundState{}, nil, xerrors.Errorf("reveal %s of round %d is invalid", round.Reveal, round.Round)
+	}
+
+	results, err := database.ListChallengeResultsByRoundTx(v.db, round.Round)
+	if err != nil {
+		return nil, RoundState{}, nil, err
+	}
+
+	ch := &challenge{
+		round:     round,
+		resultMap: make(map[types.NodeID]bool, len(results)),
+	}
+	var accepted []types.Result
+	for _, result := range results {
+		nodeID := types.NodeID{
+			Address: result.Address,
+			ID:      result.Id,
+		}
+		ch.resultMap[nodeID] = result.Success
+		if result.Success {
+			accepted = append(accepted, types.Result{
+				NodeID:     nodeID,
+				Nonce:      result.Nonce,
+				SubmitTime: result.SubmitTime,
+				Success:    true,
+			})
+		}
+	}
+
+	event := v.scheduler.Event(round.Round, PhasePrepare)
+	state := RoundState{
+		Round:      round.Round,
+		Reveal:     reveal,
+		Start:      event.Start,
+		ProveStart: event.ProveStart,
+		ProveEnd:   event.ProveEnd,
+	}
+	copy(state.RND[:], rnd)
+
+	return ch, state, accepted, nil
+}
+
+// failed returns the failed nodes
+func failed(res map[types.NodeID]bool) map[types.NodeID]bool {
+	var skipped = make(map[types.NodeID]bool)
+	for nodeID, result := range res {
+		if !result {
+			skipped[nodeID] = true
+		}
+	}
+
+	return skipped
+}
@@ -0,0 +1,169 @@
+package validator
+
+import (
+	"context"
+	"grid-prover/database"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runValidator starts the validator and waits for its scheduler, the returned
+// channel is closed when Start returns
+func runValidator(t *testing.T, v *testValidator, clock *ManualClock) chan struct{} {
+	t.Helper()
+
+	waiting := clock.waiting()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v.Start(context.Background())
+	}()
+	eventually(t, "scheduler", func() bool {
+		return clock.waiting() > waiting
+	})
+	return done
+}
+
+// abandon stops the validator without waiting for the round in flight, as a
+// crash in the middle of the round would
+func abandon(t *testing.T, v *testValidator, done chan struct{}) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	v.Stop(ctx)
+	<-done
+}
+
+// restart runs a new validator on the database of the last one
+func restart(t *testing.T, last *testValidator, clock *ManualClock) *testValidator {
+	t.Helper()
+
+	v := newTestValidator(t, clock)
+	v.SetDatabase(last.db)
+	v.db = last.db
+	return v
+}
+
+// a validator restarted in the prove window resumes the round with the same
+// rnd and the proofs it accepted before
+func TestResumeRound(t *testing.T) {
+	timing := DefaultTiming()
+	scheduler := NewScheduler(DefaultEpoch, timing, nil)
+	round := scheduler.Round(time.Now()) + 1
+	clock := NewManualClock(scheduler.RoundStart(round).Add(-time.Second))
+
+	v1 := newTestValidator(t, clock)
+	proved, late := newTestProvider(t, 0), newTestProvider(t, 0)
+	seedOrder(t, v1.db, proved.nodeID, 1, clock.Now().Add(-time.Hour), 24*time.Hour)
+	seedOrder(t, v1.db, late.nodeID, 2, clock.Now().Add(-time.Hour), 24*time.Hour)
+
+	done := runValidator(t, v1, clock)
+	clock.Advance(scheduler.Event(round, PhasePrepare).At.Sub(clock.Now()))
+	eventually(t, "prepared round", func() bool {
+		return roundStatus(v1.db, round) == database.RoundPrepared && v1.checkProof(round, proved.nodeID) == nil
+	})
+	clock.Advance(timing.Prepare)
+	err := submitProof(context.Background(), v1.client, proved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := v1.CurrentRound()
+	abandon(t, v1, done)
+	if status := roundStatus(v1.db, round); status != database.RoundPrepared {
+		t.Fatalf("abandoned round is %q", status)
+	}
+
+	v2 := restart(t, v1, clock)
+	done = runValidator(t, v2, clock)
+	resumed := v2.CurrentRound()
+	if resumed.Round != round || resumed.RND != state.RND {
+		t.Fatalf("resumed round %d with rnd %x, want round %d with rnd %x", resumed.Round, resumed.RND, round, state.RND)
+	}
+
+	// the proof accepted before the restart is still the proof of the node
+	err = submitProof(context.Background(), v2.client, proved)
+	if err == nil || !strings.Contains(err.Error(), "[409]") {
+		t.Errorf("proof accepted again after the restart: %v", err)
+	}
+	err = submitProof(context.Background(), v2.client, late)
+	if err != nil {
+		t.Errorf("proof after the restart: %v", err)
+	}
+
+	clock.Advance(scheduler.Event(round, PhaseSettle).At.Sub(clock.Now()))
+	eventually(t, "settled round", func() bool {
+		return roundStatus(v2.db, round) == database.RoundSettled
+	})
+	err = v2.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	results, err := database.ListChallengeResultsByRoundTx(v2.db, round)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || !results[0].Success || !results[1].Success {
+		t.Errorf("results %+v, want the proofs of both nodes", results)
+	}
+}
+
+// a round whose prove window passed while the validator was down is settled
+// after the restart, the proofs it accepted are rewarded and the nodes that
+// could not submit theirs are not penalized
+func TestSettleAfterRestart(t *testing.T) {
+	timing := DefaultTiming()
+	scheduler := NewScheduler(DefaultEpoch, timing, nil)
+	round := scheduler.Round(time.Now()) + 1
+	clock := NewManualClock(scheduler.RoundStart(round).Add(-time.Second))
+
+	v1 := newTestValidator(t, clock)
+	proved, missed := newTestProvider(t, 0), newTestProvider(t, 0)
+	seedOrder(t, v1.db, proved.nodeID, 1, clock.Now().Add(-time.Hour), 24*time.Hour)
+	seedOrder(t, v1.db, missed.nodeID, 2, clock.Now().Add(-time.Hour), 24*time.Hour)
+
+	done := runValidator(t, v1, clock)
+	clock.Advance(scheduler.Event(round, PhasePrepare).At.Sub(clock.Now()))
+	eventually(t, "prepared round", func() bool {
+		return roundStatus(v1.db, round) == database.RoundPrepared && v1.checkProof(round, proved.nodeID) == nil
+	})
+	clock.Advance(timing.Prepare)
+	err := submitProof(context.Background(), v1.client, proved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abandon(t, v1, done)
+
+	clock.Advance(scheduler.Event(round, PhaseSettle).At.Sub(clock.Now()) + time.Minute)
+	v2 := restart(t, v1, clock)
+	done = runValidator(t, v2, clock)
+	if status := roundStatus(v2.db, round); status != database.RoundSettled {
+		t.Fatalf("round %d is %q after the restart", round, status)
+	}
+	err = v2.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	tests := []struct {
+		name     string
+		provider testProvider
+		rewarded bool
+	}{
+		{"proved node", proved, true},
+		{"node without a proof", missed, false},
+	}
+	for _, tt := range tests {
+		profit, err := database.GetProfitByAddressTx(v2.db, tt.provider.nodeID.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (profit.Balance.Sign() > 0) != tt.rewarded || profit.Penalty.Sign() != 0 {
+			t.Errorf("%s: balance %s penalty %s", tt.name, profit.Balance, profit.Penalty)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package validator
+
+import (
+	"grid-prover/database"
+	"math/big"
+)
+
+// ProviderReport shows how the profit change of a provider in a round is
+// derived from the results of its nodes
+type ProviderReport struct {
+	Address string       `json:"address"`
+	Reward  string       `json:"reward"`
+	Penalty string       `json:"penalty"`
+	Nodes   []NodeReport `json:"nodes"`
+}
+
+type NodeReport struct {
+	ID      int                        `json:"id"`
+	Success bool                       `json:"success"`
+	Reward  string                     `json:"reward"`
+	Penalty string                     `json:"penalty"`
+	Orders  []database.OrderSettlement `json:"orders"`
+}
+
+// RoundReport builds the settlement report of the round from the challenge
+// results and the order settlements
+func (v *GRIDValidator) RoundReport(round int64) ([]ProviderReport, error) {
+	results, err := database.ListChallengeResultsByRoundTx(v.db, round)
+	if err != nil {
+		return nil, err
+	}
+
+	settlements, err := database.ListOrderSettlementsByRoundTx(v.db, round)
+	if err != nil {
+		return nil, err
+	}
+
+	type nodeKey struct {
+		address string
+		id      int
+	}
+	orders := make(map[nodeKey][]database.OrderSettlement)
+	for _, s := range settlements {
+		key := nodeKey{s.Address, s.NodeId}
+		orders[key] = append(orders[key], s)
+	}
+
+	// results are ordered by address and id
+	var reports []ProviderReport
+	for _, result := range results {
+		if len(reports) == 0 || reports[len(reports)-1].Address != result.Address {
+			reports = append(reports, ProviderReport{Address: result.Address})
+		}
+		provider := &reports[len(reports)-1]
+
+		node := NodeReport{
+			ID:      result.Id,
+			Success: result.Success,
+			Orders:  orders[nodeKey{result.Address, result.Id}],
+		}
+		reward, penalty := new(big.Int), new(big.Int)
+		for _, order := range node.Orders {
+			addDecimal(reward, order.Reward)
+			addDecimal(penalty, order.Penalty)
+		}
+		node.Reward = reward.String()
+		node.Penalty = penalty.String()
+		provider.Nodes = append(provider.Nodes, node)
+	}
+
+	for i := range reports {
+		reward, penalty := new(big.Int), new(big.Int)
+		for _, node := range reports[i].Nodes {
+			addDecimal(reward, node.Reward)
+			addDecimal(penalty, node.Penalty)
+		}
+		reports[i].Reward = reward.String()
+		reports[i].Penalty = penalty.String()
+	}
+
+	return reports, nil
+}
+
+func addDecimal(sum *big.Int, s string) {
+	value, ok := new(big.Int).SetString(s, 10)
+	if ok {
+		sum.Add(sum, value)
+	}
+}
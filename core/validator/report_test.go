@@ -0,0 +1,106 @@
+package validator
+
+import (
+	"context"
+	"grid-prover/core/types"
+	"grid-prover/database"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// each node is settled with its own result, the report adds the orders up to
+// the node and the nodes up to the provider
+func TestRoundReport(t *testing.T) {
+	const round = 7
+	now := time.Unix(1_900_000_000, 0)
+	v := newTestValidator(t, NewManualClock(now))
+
+	first, second := newTestProvider(t, 0), newTestProvider(t, 0)
+	tests := []struct {
+		name    string
+		node    types.NodeID
+		orders  []uint64
+		success bool
+	}{
+		{"proved node", first.nodeID, []uint64{1, 2}, true},
+		{"missed node of the same provider", types.NodeID{Address: first.nodeID.Address, ID: 1}, []uint64{3}, false},
+		{"missed node of another provider", second.nodeID, []uint64{4}, false},
+	}
+
+	res := make(map[types.NodeID]bool)
+	for _, tt := range tests {
+		for _, order := range tt.orders {
+			seedOrder(t, v.db, tt.node, order, now.Add(-time.Hour), 24*time.Hour)
+		}
+		res[tt.node] = tt.success
+	}
+
+	// a settled round is not settled again, e.g. after a restart
+	for i := 0; i < 2; i++ {
+		err := v.AddPenalty(context.Background(), round, now, res)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	results := make([]database.ChallengeResult, 0, len(tests))
+	for _, tt := range tests {
+		results = append(results, database.ChallengeResult{Round: round, Address: tt.node.Address, Id: tt.node.ID, Success: tt.success})
+	}
+	err := database.CreateChallengeResultsTx(v.db, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports, err := v.RoundReport(round)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := make(map[types.NodeID]NodeReport)
+	providers := make(map[string]ProviderReport)
+	for _, provider := range reports {
+		providers[provider.Address] = provider
+		for _, node := range provider.Nodes {
+			nodes[types.NodeID{Address: provider.Address, ID: node.ID}] = node
+		}
+	}
+	if len(providers) != 2 || len(nodes) != len(tests) {
+		t.Fatalf("report of %d providers and %d nodes", len(providers), len(nodes))
+	}
+
+	// an order of a day released for an hour, 1% of the rest for a miss
+	const reward, fine = 1000 * 3600, 1000 * (86400 - 3600) / 100
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := nodes[tt.node]
+			if node.Success != tt.success || len(node.Orders) != len(tt.orders) {
+				t.Fatalf("node %+v", node)
+			}
+			penalty := 0
+			if !tt.success {
+				penalty = fine
+			}
+			for _, order := range node.Orders {
+				if order.Reward != strconv.Itoa(reward) || order.Penalty != strconv.Itoa(penalty) {
+					t.Errorf("order %d: reward %s penalty %s", order.OrderId, order.Reward, order.Penalty)
+				}
+			}
+			if node.Reward != strconv.Itoa(reward*len(tt.orders)) || node.Penalty != strconv.Itoa(penalty*len(tt.orders)) {
+				t.Errorf("node reward %s penalty %s", node.Reward, node.Penalty)
+			}
+		})
+	}
+
+	for address, provider := range providers {
+		profit, err := database.GetProfitByAddressTx(v.db, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if profit.Balance.String() != provider.Reward || profit.Penalty.String() != provider.Penalty {
+			t.Errorf("provider %s: balance %s penalty %s, report %+v", address, profit.Balance, profit.Penalty, provider)
+		}
+	}
+	if provider := providers[first.nodeID.Address]; provider.Reward != strconv.Itoa(3*reward) || provider.Penalty != strconv.Itoa(fine) {
+		t.Errorf("provider of two nodes: reward %s penalty %s", provider.Reward, provider.Penalty)
+	}
+}
@@ -0,0 +1,191 @@
+package validator
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"golang.org/x/xerrors"
+)
+
+// RNDSource generates the challenge rnd of each round. Commit is called before
+// the prepare window of the round and its result is published, Reveal is
+// called when the round starts and returns the rnd with the data that lets
+// provers check it against the commitment.
+type RNDSource interface {
+	Name() string
+	Commit(ctx context.Context, round int64) ([]byte, error)
+	Reveal(ctx context.Context, round int64) ([32]byte, []byte, error)
+}
+
+// CryptoRND reads the rnd from crypto/rand, it can not be verified
+type CryptoRND struct{}
+
+func (CryptoRND) Name() string {
+	return "crypto"
+}
+
+func (CryptoRND) Commit(ctx context.Context, round int64) ([]byte, error) {
+	return nil, nil
+}
+
+func (CryptoRND) Reveal(ctx context.Context, round int64) ([32]byte, []byte, error) {
+	var rnd [32]byte
+	_, err := rand.Read(rnd[:])
+	return rnd, nil, err
+}
+
+// CommitRevealRND publishes keccak256(seed) before the round and reveals the
+// seed as the rnd of the round. The seeds are only kept in memory, a round
+// committed before a restart can not be revealed and is skipped.
+type CommitRevealRND struct {
+	lk    sync.Mutex
+	seeds map[int64][32]byte
+}
+
+func NewCommitRevealRND() *CommitRevealRND {
+	return &CommitRevealRND{
+		seeds: make(map[int64][32]byte),
+	}
+}
+
+func (c *CommitRevealRND) Name() string {
+	return "commit-reveal"
+}
+
+func (c *CommitRevealRND) Commit(ctx context.Context, round int64) ([]byte, error) {
+	var seed [32]byte
+	_, err := rand.Read(seed[:])
+	if err != nil {
+		return nil, err
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.seeds[round] = seed
+
+	return crypto.Keccak256(seed[:]), nil
+}
+
+func (c *CommitRevealRND) Reveal(ctx context.Context, round int64) ([32]byte, []byte, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	seed, ok := c.seeds[round]
+	if !ok {
+		return [32]byte{}, nil, xerrors.Errorf("round %d is not committed", round)
+	}
+	// the seeds of this and older rounds are not needed any more
+	for r := range c.seeds {
+		if r <= round {
+			delete(c.seeds, r)
+		}
+	}
+
+	return seed, seed[:], nil
+}
+
+// VerifyCommitReveal checks the reveal of a CommitRevealRND round
+func VerifyCommitReveal(commitment, reveal []byte, rnd [32]byte) bool {
+	return bytes.Equal(crypto.Keccak256(reveal), commitment) && bytes.Equal(reveal, rnd[:])
+}
+
+// BlockHashRND commits to a block that is not mined yet and derives the rnd
+// from its hash as keccak256(blockHash || uint64 round). The commitment is
+// published when the previous round settles, so the block is mined by the
+// time the round starts.
+type BlockHashRND struct {
+	endpoint string
+	delay    uint64
+
+	lk      sync.Mutex
+	targets map[int64]uint64
+}
+
+func NewBlockHashRND(endpoint string, delay uint64) *BlockHashRND {
+	if delay == 0 {
+		delay = 1
+	}
+	return &BlockHashRND{
+		endpoint: endpoint,
+		delay:    delay,
+		targets:  make(map[int64]uint64),
+	}
+}
+
+func (b *BlockHashRND) Name() string {
+	return "block-hash"
+}
+
+// Commit returns the uint64 number of the block the rnd will come from
+func (b *BlockHashRND) Commit(ctx context.Context, round int64) ([]byte, error) {
+	client, err := ethclient.DialContext(ctx, b.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	head, err := client.BlockNumber(ctx)
+	if err != nil {
+		return nil, err
+	}
+	target := head + b.delay
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.targets[round] = target
+
+	var commitment = make([]byte, 8)
+	binary.BigEndian.PutUint64(commitment, target)
+	return commitment, nil
+}
+
+// Reveal returns the hash of the committed block as the reveal
+func (b *BlockHashRND) Reveal(ctx context.Context, round int64) ([32]byte, []byte, error) {
+	b.lk.Lock()
+	target, ok := b.targets[round]
+	for r := range b.targets {
+		if r <= round {
+			delete(b.targets, r)
+		}
+	}
+	b.lk.Unlock()
+	if !ok {
+		return [32]byte{}, nil, xerrors.Errorf("round %d is not committed", round)
+	}
+
+	client, err := ethclient.DialContext(ctx, b.endpoint)
+	if err != nil {
+		return [32]byte{}, nil, err
+	}
+	defer client.Close()
+
+	header, err := client.HeaderByNumber(ctx, new(big.Int).SetUint64(target))
+	if err != nil {
+		return [32]byte{}, nil, xerrors.Errorf("Failed to get committed block %d: %w", target, err)
+	}
+
+	hash := header.Hash()
+	return blockHashRND(hash, round), hash.Bytes(), nil
+}
+
+// VerifyBlockHash checks the reveal of a BlockHashRND round, the caller should
+// check that the reveal is the hash of the committed block
+func VerifyBlockHash(round int64, reveal []byte, rnd [32]byte) bool {
+	return len(reveal) == common.HashLength && blockHashRND(common.BytesToHash(reveal), round) == rnd
+}
+
+func blockHashRND(hash common.Hash, round int64) [32]byte {
+	var roundBuf = make([]byte, 8)
+	binary.BigEndian.PutUint64(roundBuf, uint64(round))
+
+	var rnd [32]byte
+	copy(rnd[:], crypto.Keccak256(hash.Bytes(), roundBuf))
+	return rnd
+}
@@ -0,0 +1,194 @@
+package validator
+
+import (
+	"context"
+	"encoding/hex"
+	"grid-prover/database"
+	"testing"
+	"time"
+)
+
+func checkCommitReveal(t *testing.T, v *testValidator, round int64) {
+	t.Helper()
+
+	challengeRound, err := database.GetChallengeRoundTx(v.db, round)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitment, _ := hex.DecodeString(challengeRound.Commitment)
+	reveal, _ := hex.DecodeString(challengeRound.Reveal)
+	rndBytes, _ := hex.DecodeString(challengeRound.RND)
+	var rnd [32]byte
+	copy(rnd[:], rndBytes)
+	if !VerifyCommitReveal(commitment, reveal, rnd) {
+		t.Fatalf("round %d: reveal does not match the commitment", round)
+	}
+}
+
+// a restart must not replace a published commitment, the round committed by
+// the last run is skipped instead
+func TestCommitRevealRestart(t *testing.T) {
+	timing := DefaultTiming()
+	scheduler := NewScheduler(DefaultEpoch, timing, nil)
+	first := scheduler.Round(time.Now()) + 1
+	clock := NewManualClock(scheduler.RoundStart(first).Add(-time.Second))
+
+	// run drives the validator through the rounds, the skipped round is not prepared
+	run := func(v *testValidator, skip int64, rounds ...int64) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		waiting := clock.waiting()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			v.Start(ctx)
+		}()
+		// the first round is committed before the scheduler waits for it
+		eventually(t, "scheduler", func() bool {
+			return clock.waiting() > waiting
+		})
+
+		for _, round := range rounds {
+			clock.Advance(scheduler.Event(round, PhasePrepare).At.Sub(clock.Now()))
+			if round != skip {
+				eventually(t, "prepared round", func() bool {
+					return roundStatus(v.db, round) == database.RoundPrepared
+				})
+			}
+
+			clock.Advance(scheduler.Event(round, PhaseSettle).At.Sub(clock.Now()))
+			eventually(t, "next commitment", func() bool {
+				challengeRound, err := database.GetChallengeRoundTx(v.db, round+1)
+				return err == nil && challengeRound.Commitment != ""
+			})
+		}
+
+		err := v.Stop(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+	}
+
+	v1 := newTestValidator(t, clock)
+	v1.SetRNDSource(NewCommitRevealRND())
+	run(v1, -1, first)
+	if status := roundStatus(v1.db, first); status != database.RoundSettled {
+		t.Fatalf("round %d is %q", first, status)
+	}
+	checkCommitReveal(t, v1, first)
+
+	committed, err := database.GetChallengeRoundTx(v1.db, first+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the seed of the next round is lost with the first run
+	v2 := newTestValidator(t, clock)
+	v2.SetDatabase(v1.db)
+	v2.db = v1.db
+	v2.SetRNDSource(NewCommitRevealRND())
+	run(v2, first+1, first+1, first+2)
+
+	skipped, err := database.GetChallengeRoundTx(v1.db, first+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped.Commitment != committed.Commitment {
+		t.Fatalf("commitment of round %d is replaced", first+1)
+	}
+	if skipped.Status != "" || skipped.RND != "" {
+		t.Fatalf("round %d without its seed is run: %q", first+1, skipped.Status)
+	}
+
+	if status := roundStatus(v1.db, first+2); status != database.RoundSettled {
+		t.Fatalf("round %d is %q", first+2, status)
+	}
+	checkCommitReveal(t, v1, first+2)
+}
+
+// lateRND publishes the commitment of one round only after the round started,
+// as a source waiting on a slow chain would
+type lateRND struct {
+	*CommitRevealRND
+	clock *ManualClock
+	round int64
+	at    time.Time
+}
+
+func (r lateRND) Commit(ctx context.Context, round int64) ([]byte, error) {
+	if round == r.round {
+		r.clock.Advance(r.at.Sub(r.clock.Now()))
+	}
+	return r.CommitRevealRND.Commit(ctx, round)
+}
+
+// a round whose commitment is published after it started is skipped even if
+// its prepare window is still open
+func TestLateCommitSkipsRound(t *testing.T) {
+	timing := DefaultTiming()
+	scheduler := NewScheduler(DefaultEpoch, timing, nil)
+	first := scheduler.Round(time.Now()) + 1
+	late := first + 1
+	clock := NewManualClock(scheduler.RoundStart(first).Add(-time.Second))
+
+	v := newTestValidator(t, clock)
+	v.SetRNDSource(lateRND{
+		CommitRevealRND: NewCommitRevealRND(),
+		clock:           clock,
+		round:           late,
+		at:              scheduler.RoundStart(late).Add(time.Second),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	waiting := clock.waiting()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v.Start(ctx)
+	}()
+	eventually(t, "scheduler", func() bool {
+		return clock.waiting() > waiting
+	})
+
+	committed := func(round int64) func() bool {
+		return func() bool {
+			challengeRound, err := database.GetChallengeRoundTx(v.db, round)
+			return err == nil && challengeRound.Commitment != ""
+		}
+	}
+	for _, round := range []int64{first, late, late + 1} {
+		if clock.Now().Before(scheduler.Event(round, PhasePrepare).At) {
+			clock.Advance(scheduler.Event(round, PhasePrepare).At.Sub(clock.Now()))
+		}
+		if round != late {
+			eventually(t, "prepared round", func() bool {
+				return roundStatus(v.db, round) == database.RoundPrepared
+			})
+		}
+
+		clock.Advance(scheduler.Event(round, PhaseSettle).At.Sub(clock.Now()))
+		eventually(t, "next commitment", committed(round+1))
+	}
+
+	err := v.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	skipped, err := database.GetChallengeRoundTx(v.db, late)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped.Status != "" || skipped.RND != "" {
+		t.Errorf("round %d committed after its start is run: %q", late, skipped.Status)
+	}
+	for _, round := range []int64{first, late + 1} {
+		if status := roundStatus(v.db, round); status != database.RoundSettled {
+			t.Errorf("round %d is %q", round, status)
+		}
+		checkCommitReveal(t, v, round)
+	}
+}
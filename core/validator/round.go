@@ -0,0 +1,144 @@
+package validator
+
+import (
+	"fmt"
+	"grid-prover/core/types"
+	"grid-prover/logs"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+var ErrNotChallenged = xerrors.New("node is not challenged in this round")
+
+// RoundState is the challenge round the validator is running
+type RoundState struct {
+	Round      int64
+	RND        [32]byte
+	Reveal     []byte    // 用于验证RND的揭示值
+	Start      time.Time // prepare时期开始时间
+	ProveStart time.Time // prove时期开始时间
+	ProveEnd   time.Time // prove时期结束时间
+}
+
+// CurrentRound returns a copy of the state of the current round
+func (v *GRIDValidator) CurrentRound() RoundState {
+	v.roundLock.RLock()
+	defer v.roundLock.RUnlock()
+
+	return v.round
+}
+
+// setRound starts a new round, the challenged nodes and proofs of the last round are dropped
+func (v *GRIDValidator) setRound(round RoundState) {
+	v.roundLock.Lock()
+	defer v.roundLock.Unlock()
+
+	v.round = round
+	v.closed = false
+	v.challenged = nil
+	v.accepted = make(map[types.NodeID]types.Result)
+}
+
+// restoreRound resumes a round of the last run with its challenged nodes and
+// accepted proofs
+func (v *GRIDValidator) restoreRound(round RoundState, resultMap map[types.NodeID]bool, accepted []types.Result) {
+	v.roundLock.Lock()
+	defer v.roundLock.Unlock()
+
+	v.round = round
+	v.closed = false
+	v.challenged = make(map[types.NodeID]bool, len(resultMap))
+	for nodeID := range resultMap {
+		v.challenged[nodeID] = true
+	}
+	v.accepted = make(map[types.NodeID]types.Result, len(accepted))
+	for _, result := range accepted {
+		v.accepted[result.NodeID] = result
+	}
+}
+
+// drainProofs waits for the proof handlers in flight and closes the round, no
+// proof is accepted in the round after it returns
+func (v *GRIDValidator) drainProofs(round int64) {
+	v.proofLock.Lock()
+	defer v.proofLock.Unlock()
+
+	v.roundLock.Lock()
+	defer v.roundLock.Unlock()
+
+	if v.round.Round == round {
+		v.closed = true
+	}
+}
+
+func (v *GRIDValidator) setChallengeNode(round int64, resultMap map[types.NodeID]bool) {
+	v.roundLock.Lock()
+	defer v.roundLock.Unlock()
+
+	if v.round.Round != round {
+		return
+	}
+
+	v.challenged = make(map[types.NodeID]bool, len(resultMap))
+	for nodeID := range resultMap {
+		v.challenged[nodeID] = true
+	}
+}
+
+// checkProof reports whether a proof of the node can still be accepted in the round
+func (v *GRIDValidator) checkProof(round int64, nodeID types.NodeID) error {
+	v.roundLock.RLock()
+	defer v.roundLock.RUnlock()
+
+	return v.checkProofLocked(round, nodeID)
+}
+
+func (v *GRIDValidator) checkProofLocked(round int64, nodeID types.NodeID) error {
+	if v.round.Round != round || v.closed {
+		return logs.RoundError{Message: fmt.Sprintf("round %d is over", round)}
+	}
+	if !v.challenged[nodeID] {
+		return ErrNotChallenged
+	}
+	if _, ok := v.accepted[nodeID]; ok {
+		return logs.ConflictError{Message: "proof of the node is already accepted in this round"}
+	}
+
+	return nil
+}
+
+// acceptProof records the proof of the node, only one proof is accepted per node and round
+func (v *GRIDValidator) acceptProof(round int64, result types.Result) error {
+	v.roundLock.Lock()
+	defer v.roundLock.Unlock()
+
+	err := v.checkProofLocked(round, result.NodeID)
+	if err != nil {
+		return err
+	}
+
+	v.accepted[result.NodeID] = result
+	return nil
+}
+
+// acceptedProofs returns the proofs accepted in the round
+func (v *GRIDValidator) acceptedProofs(round int64) []types.Result {
+	v.roundLock.RLock()
+	defer v.roundLock.RUnlock()
+
+	if v.round.Round != round {
+		return nil
+	}
+
+	var results = make([]types.Result, 0, len(v.accepted))
+	for _, result := range v.accepted {
+		results = append(results, result)
+	}
+	return results
+}
+
+// InProveWindow reports whether t is in the prove window of the round
+func (r RoundState) InProveWindow(t time.Time) bool {
+	return !t.Before(r.ProveStart) && !t.After(r.ProveEnd)
+}
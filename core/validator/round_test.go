@@ -0,0 +1,106 @@
+package validator
+
+import (
+	"errors"
+	"fmt"
+	"grid-prover/core/types"
+	"grid-prover/logs"
+	"testing"
+	"time"
+)
+
+func isConflict(err error) bool {
+	var conflict logs.ConflictError
+	return errors.As(err, &conflict)
+}
+
+func isRoundOver(err error) bool {
+	var round logs.RoundError
+	return errors.As(err, &round)
+}
+
+func isNotChallenged(err error) bool {
+	return errors.Is(err, ErrNotChallenged)
+}
+
+// the steps run in order on one round, each node has one proof accepted at most
+func TestAcceptProof(t *testing.T) {
+	challenged := types.NodeID{Address: "0x01", ID: 0}
+	other := types.NodeID{Address: "0x01", ID: 1}
+	unchallenged := types.NodeID{Address: "0x02", ID: 0}
+
+	steps := []struct {
+		name  string
+		round int64
+		node  types.NodeID
+		close bool // 接受前关闭本轮
+		want  func(error) bool
+	}{
+		{"first proof", 7, challenged, false, nil},
+		{"second proof", 7, challenged, false, isConflict},
+		{"other node", 7, other, false, nil},
+		{"unchallenged node", 7, unchallenged, false, isNotChallenged},
+		{"last round", 6, other, false, isRoundOver},
+		{"next round", 8, other, false, isRoundOver},
+		{"closed round", 7, challenged, true, isRoundOver},
+	}
+
+	v := &GRIDValidator{}
+	v.setRound(RoundState{Round: 7})
+	v.setChallengeNode(7, map[types.NodeID]bool{challenged: false, other: false})
+	for _, step := range steps {
+		if step.close {
+			v.drainProofs(7)
+		}
+		err := v.acceptProof(step.round, types.Result{NodeID: step.node, Success: true})
+		if step.want == nil && err != nil {
+			t.Errorf("%s: %v", step.name, err)
+		}
+		if step.want != nil && !step.want(err) {
+			t.Errorf("%s: unexpected error %v", step.name, err)
+		}
+	}
+
+	accepted := v.acceptedProofs(7)
+	if len(accepted) != 2 {
+		t.Errorf("%d proofs accepted, want 2", len(accepted))
+	}
+	if len(v.acceptedProofs(8)) != 0 {
+		t.Error("proofs of another round are returned")
+	}
+}
+
+// nothing reads the accepted proofs until the round settles, accepting them
+// must not wait for a reader however many nodes prove
+func TestAcceptProofNeverBlocks(t *testing.T) {
+	const nodes = 10000
+	resultMap := make(map[types.NodeID]bool, nodes)
+	for i := 0; i < nodes; i++ {
+		resultMap[types.NodeID{Address: fmt.Sprintf("0x%040x", i)}] = false
+	}
+
+	v := &GRIDValidator{}
+	v.setRound(RoundState{Round: 1})
+	v.setChallengeNode(1, resultMap)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for nodeID := range resultMap {
+			err := v.acceptProof(1, types.Result{NodeID: nodeID, Success: true})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("accepting proofs blocks")
+	}
+	if len(v.acceptedProofs(1)) != nodes {
+		t.Errorf("%d proofs accepted, want %d", len(v.acceptedProofs(1)), nodes)
+	}
+}
@@ -0,0 +1,144 @@
+package validator
+
+import (
+	"encoding/binary"
+	"grid-prover/core/types"
+	"math"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/xerrors"
+)
+
+type Candidate struct {
+	NodeID    types.NodeID
+	Value     *big.Int // 节点有效订单的总价值
+	Failures  int64    // 最近窗口内挑战失败次数
+	LastRound int64    // 上次被挑战的轮次, 0表示从未被挑战
+}
+
+// SamplingPolicy chooses the nodes challenged in a round from the nodes with
+// active orders
+type SamplingPolicy interface {
+	Name() string
+	Sample(round int64, rnd [32]byte, candidates []Candidate) []types.NodeID
+}
+
+// AllNodes challenges every candidate in every round
+type AllNodes struct{}
+
+func (AllNodes) Name() string {
+	return "all"
+}
+
+func (AllNodes) Sample(round int64, rnd [32]byte, candidates []Candidate) []types.NodeID {
+	var nodes = make([]types.NodeID, 0, len(candidates))
+	for _, candidate := range candidates {
+		nodes = append(nodes, candidate.NodeID)
+	}
+	return nodes
+}
+
+// WeightedSampling challenges about Rate of the candidates in a round. The
+// sample is weighted by order value and recent failures and is derived from
+// the rnd only, so anyone can check it. A node not challenged in the last
+// Window rounds is always challenged.
+type WeightedSampling struct {
+	Rate   float64
+	Window int64
+}
+
+func NewWeightedSampling(rate float64, window int64) (*WeightedSampling, error) {
+	if rate <= 0 || rate > 1 {
+		return nil, xerrors.Errorf("sampling rate %f is not in (0, 1]", rate)
+	}
+	if window <= 0 {
+		return nil, xerrors.Errorf("sampling window %d must be positive", window)
+	}
+
+	return &WeightedSampling{
+		Rate:   rate,
+		Window: window,
+	}, nil
+}
+
+func (w *WeightedSampling) Name() string {
+	return "sampling"
+}
+
+func (w *WeightedSampling) Sample(round int64, rnd [32]byte, candidates []Candidate) []types.NodeID {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	target := int(math.Ceil(w.Rate * float64(len(candidates))))
+
+	mean := new(big.Float)
+	for _, candidate := range candidates {
+		if candidate.Value != nil {
+			mean.Add(mean, new(big.Float).SetInt(candidate.Value))
+		}
+	}
+	mean.Quo(mean, big.NewFloat(float64(len(candidates))))
+
+	type key struct {
+		nodeID types.NodeID
+		forced bool
+		key    float64
+	}
+	var keys = make([]key, 0, len(candidates))
+	for _, candidate := range candidates {
+		keys = append(keys, key{
+			nodeID: candidate.NodeID,
+			forced: candidate.LastRound == 0 || round-candidate.LastRound >= w.Window,
+			key:    sampleKey(rnd, candidate.NodeID, w.weight(candidate, mean)),
+		})
+	}
+
+	// forced nodes first, then the weighted random order
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].forced != keys[j].forced {
+			return keys[i].forced
+		}
+		if keys[i].key != keys[j].key {
+			return keys[i].key > keys[j].key
+		}
+		if keys[i].nodeID.Address != keys[j].nodeID.Address {
+			return keys[i].nodeID.Address < keys[j].nodeID.Address
+		}
+		return keys[i].nodeID.ID < keys[j].nodeID.ID
+	})
+
+	var nodes []types.NodeID
+	for i, k := range keys {
+		if i >= target && !k.forced {
+			break
+		}
+		nodes = append(nodes, k.nodeID)
+	}
+
+	return nodes
+}
+
+// weight is (1 + value / mean value) * (1 + failures)
+func (w *WeightedSampling) weight(candidate Candidate, mean *big.Float) float64 {
+	weight := 1.0
+	if candidate.Value != nil && mean.Sign() > 0 {
+		ratio, _ := new(big.Float).Quo(new(big.Float).SetInt(candidate.Value), mean).Float64()
+		weight += ratio
+	}
+
+	return weight * float64(1+candidate.Failures)
+}
+
+// sampleKey is ln(u) / weight with u uniform in (0, 1) from the rnd and the
+// node, taking the largest keys is a weighted sample without replacement
+func sampleKey(rnd [32]byte, nodeID types.NodeID, weight float64) float64 {
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, uint64(nodeID.ID))
+	hash := crypto.Keccak256(rnd[:], []byte(nodeID.Address), id)
+
+	u := (float64(binary.BigEndian.Uint64(hash)>>11) + 0.5) / (1 << 53)
+	return math.Log(u) / weight
+}
@@ -0,0 +1,189 @@
+package validator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"grid-prover/core/types"
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func testRND(round int64) [32]byte {
+	var seed [8]byte
+	binary.BigEndian.PutUint64(seed[:], uint64(round))
+	return crypto.Keccak256Hash(seed[:])
+}
+
+func testCandidates(n int) []Candidate {
+	var candidates []Candidate
+	for i := 0; i < n; i++ {
+		candidates = append(candidates, Candidate{
+			NodeID: types.NodeID{Address: common.BigToAddress(big.NewInt(int64(i + 1))).Hex(), ID: i % 3},
+			Value:  big.NewInt(1000),
+		})
+	}
+	return candidates
+}
+
+// sampleRounds samples the candidates from the first round on, a sampled node
+// has its last round moved, and counts how often each node is sampled
+func sampleRounds(policy SamplingPolicy, candidates []Candidate, first, rounds int64) map[types.NodeID]int {
+	sampled := make(map[types.NodeID]int)
+	for round := first; round < first+rounds; round++ {
+		nodes := make(map[types.NodeID]bool)
+		for _, nodeID := range policy.Sample(round, testRND(round), candidates) {
+			nodes[nodeID] = true
+			sampled[nodeID]++
+		}
+		for i := range candidates {
+			if nodes[candidates[i].NodeID] {
+				candidates[i].LastRound = round
+			}
+		}
+	}
+	return sampled
+}
+
+// the sample is a function of the rnd, any validator gets the same nodes
+func TestWeightedSamplingDeterministic(t *testing.T) {
+	policy, err := NewWeightedSampling(0.3, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := testCandidates(100)
+	for i := range candidates {
+		candidates[i].LastRound = 1
+		candidates[i].Failures = int64(i % 4)
+	}
+
+	const round = 10
+	first := policy.Sample(round, testRND(round), candidates)
+	if len(first) != 30 {
+		t.Fatalf("%d nodes sampled, want 30", len(first))
+	}
+
+	// the order of the candidates does not matter
+	reversed := make([]Candidate, len(candidates))
+	for i, candidate := range candidates {
+		reversed[len(candidates)-1-i] = candidate
+	}
+	for _, c := range [][]Candidate{candidates, reversed} {
+		again := policy.Sample(round, testRND(round), c)
+		if fmt.Sprint(again) != fmt.Sprint(first) {
+			t.Errorf("sample %v, then %v", first, again)
+		}
+	}
+
+	other := policy.Sample(round, testRND(round+1), candidates)
+	if fmt.Sprint(other) == fmt.Sprint(first) {
+		t.Errorf("another rnd samples the same nodes")
+	}
+}
+
+// the fraction of the nodes sampled in a round is the rate, and the fraction of
+// the rounds a node of equal weight is sampled in converges to the rate
+func TestWeightedSamplingRate(t *testing.T) {
+	const n, rounds = 40, 4000
+
+	for _, rate := range []float64{0.05, 0.2, 0.5} {
+		t.Run(fmt.Sprint(rate), func(t *testing.T) {
+			policy, err := NewWeightedSampling(rate, 1<<40)
+			if err != nil {
+				t.Fatal(err)
+			}
+			candidates := testCandidates(n)
+			for i := range candidates {
+				candidates[i].LastRound = 1
+			}
+
+			total := 0
+			for nodeID, count := range sampleRounds(policy, candidates, 2, rounds) {
+				total += count
+				got := float64(count) / rounds
+				if math.Abs(got-rate) > rate*0.3 {
+					t.Errorf("node %v sampled in %f of the rounds, want %f", nodeID, got, rate)
+				}
+			}
+			want := math.Ceil(rate*n) / n
+			if got := float64(total) / (n * rounds); got != want {
+				t.Errorf("sampled %f of the nodes, want %f", got, want)
+			}
+		})
+	}
+}
+
+// a node of more value or more failures is sampled more often
+func TestWeightedSamplingWeight(t *testing.T) {
+	const n, rounds = 100, 1000
+
+	tests := []struct {
+		name  string
+		heavy func(c *Candidate)
+	}{
+		{"value", func(c *Candidate) { c.Value = big.NewInt(10000) }},
+		{"failures", func(c *Candidate) { c.Failures = 3 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := NewWeightedSampling(0.2, 1<<40)
+			if err != nil {
+				t.Fatal(err)
+			}
+			candidates := testCandidates(n)
+			heavy := make(map[types.NodeID]bool)
+			for i := range candidates {
+				candidates[i].LastRound = 1
+				if i%2 == 0 {
+					tt.heavy(&candidates[i])
+					heavy[candidates[i].NodeID] = true
+				}
+			}
+
+			var heavyCount, lightCount int
+			for nodeID, count := range sampleRounds(policy, candidates, 2, rounds) {
+				if heavy[nodeID] {
+					heavyCount += count
+				} else {
+					lightCount += count
+				}
+			}
+			if heavyCount <= 2*lightCount {
+				t.Errorf("heavy nodes sampled %d times, light nodes %d times", heavyCount, lightCount)
+			}
+		})
+	}
+}
+
+// a node is challenged at least once in every Window rounds however light it is
+func TestWeightedSamplingWindow(t *testing.T) {
+	const n, rounds, window = 100, 500, 8
+
+	policy, err := NewWeightedSampling(0.05, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := testCandidates(n)
+	// the heavy nodes take the whole rate
+	for i := range candidates[:n/10] {
+		candidates[i].Value = big.NewInt(1_000_000)
+		candidates[i].Failures = 10
+	}
+
+	last := make(map[types.NodeID]int64)
+	for round := int64(1); round <= rounds; round++ {
+		sampleRounds(policy, candidates, round, 1)
+		for _, candidate := range candidates {
+			if candidate.LastRound == round {
+				last[candidate.NodeID] = round
+			}
+			if round-last[candidate.NodeID] > window {
+				t.Fatalf("node %v is not challenged since round %d at round %d", candidate.NodeID, last[candidate.NodeID], round)
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package validator
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of the scheduler, tests can replace it to move
+// through rounds without waiting
+type Clock interface {
+	Now() time.Time
+	// WaitUntil returns a channel that receives the time once t is reached
+	WaitUntil(t time.Time) <-chan time.Time
+}
+
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) WaitUntil(t time.Time) <-chan time.Time {
+	return time.After(time.Until(t))
+}
+
+// ManualClock only moves when it is advanced
+type ManualClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{
+		now: now,
+	}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *ManualClock) WaitUntil(t time.Time) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if !t.After(c.now) {
+		ch <- c.now
+		return ch
+	}
+
+	c.waiters = append(c.waiters, waiter{at: t, ch: ch})
+	sort.Slice(c.waiters, func(i, j int) bool {
+		return c.waiters[i].at.Before(c.waiters[j].at)
+	})
+	return ch
+}
+
+// Advance moves the clock forward by d and wakes the waiters that are due
+func (c *ManualClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	for len(c.waiters) > 0 && !c.waiters[0].at.After(c.now) {
+		c.waiters[0].ch <- c.now
+		c.waiters = c.waiters[1:]
+	}
+}
+
+// DefaultEpoch is the start of round 0
+var DefaultEpoch = time.Unix(0, 0)
+
+type Phase string
+
+const (
+	PhasePrepare Phase = "prepare" // 生成随机数, 选择挑战节点
+	PhaseProve   Phase = "prove"   // 接收证明
+	PhaseSettle  Phase = "settle"  // 统计结果, 结算
+)
+
+// PhaseEvent is emitted when a phase of a round starts
+type PhaseEvent struct {
+	Phase      Phase
+	Round      int64
+	At         time.Time // 阶段开始时间
+	Start      time.Time // 本轮开始时间
+	ProveStart time.Time
+	ProveEnd   time.Time
+}
+
+// Scheduler derives the round boundaries from a fixed epoch, round n starts at
+// epoch + n * cycle so rounds never drift however late the events are handled
+type Scheduler struct {
+	epoch  time.Time
+	timing Timing
+	clock  Clock
+}
+
+func NewScheduler(epoch time.Time, timing Timing, clock Clock) *Scheduler {
+	return &Scheduler{
+		epoch:  epoch,
+		timing: timing,
+		clock:  clock,
+	}
+}
+
+func (s *Scheduler) Clock() Clock {
+	return s.clock
+}
+
+// Round returns the round at t
+func (s *Scheduler) Round(t time.Time) int64 {
+	elapsed := t.Sub(s.epoch)
+	round := int64(elapsed / s.timing.Cycle)
+	if elapsed < 0 && elapsed%s.timing.Cycle != 0 {
+		round--
+	}
+
+	return round
+}
+
+func (s *Scheduler) RoundStart(round int64) time.Time {
+	return s.epoch.Add(time.Duration(round) * s.timing.Cycle)
+}
+
+func (s *Scheduler) Event(round int64, phase Phase) PhaseEvent {
+	start := s.RoundStart(round)
+	event := PhaseEvent{
+		Phase:      phase,
+		Round:      round,
+		Start:      start,
+		ProveStart: start.Add(s.timing.Prepare),
+		ProveEnd:   start.Add(s.timing.Prepare + s.timing.Prove),
+	}
+
+	switch phase {
+	case PhasePrepare:
+		event.At = event.Start
+	case PhaseProve:
+		event.At = event.ProveStart
+	case PhaseSettle:
+		event.At = event.ProveEnd
+	}
+
+	return event
+}
+
+// First returns the first event to handle at now, the current round is joined
+// if it is still in the prepare window
+func (s *Scheduler) First(now time.Time) PhaseEvent {
+	round := s.Round(now)
+	if now.Before(s.RoundStart(round).Add(s.timing.Prepare)) {
+		return s.Event(round, PhasePrepare)
+	}
+
+	return s.Event(round+1, PhasePrepare)
+}
+
+func (s *Scheduler) Next(event PhaseEvent) PhaseEvent {
+	switch event.Phase {
+	case PhasePrepare:
+		return s.Event(event.Round, PhaseProve)
+	case PhaseProve:
+		return s.Event(event.Round, PhaseSettle)
+	default:
+		return s.Event(event.Round+1, PhasePrepare)
+	}
+}
+
+// Run emits the phase events in order from first until ctx is done. An event
+// is sent once its time is reached, a slow receiver gets the events late but
+// never out of order.
+func (s *Scheduler) Run(ctx context.Context, first PhaseEvent) <-chan PhaseEvent {
+	events := make(chan PhaseEvent)
+	go func() {
+		defer close(events)
+
+		event := first
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.clock.WaitUntil(event.At):
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case events <- event:
+			}
+
+			event = s.Next(event)
+		}
+	}()
+
+	return events
+}
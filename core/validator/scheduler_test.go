@@ -0,0 +1,106 @@
+package validator
+
+import (
+	"context"
+	"grid-prover/database"
+	"testing"
+	"time"
+)
+
+func TestSchedulerRun(t *testing.T) {
+	timing := DefaultTiming()
+	clock := NewManualClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	scheduler := NewScheduler(DefaultEpoch, timing, clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := scheduler.First(clock.Now())
+	events := scheduler.Run(ctx, first)
+
+	const rounds = 500
+	want := first
+	for i := 0; i < rounds*3; i++ {
+		clock.Advance(want.At.Sub(clock.Now()))
+		event := <-events
+		if event != want {
+			t.Fatalf("event %+v, want %+v", event, want)
+		}
+		if event.At.Sub(scheduler.RoundStart(event.Round)) >= timing.Cycle {
+			t.Fatalf("event %+v is out of its round", event)
+		}
+		want = scheduler.Next(event)
+	}
+	if want.Round != first.Round+rounds || want.Phase != PhasePrepare {
+		t.Fatalf("stopped at %+v", want)
+	}
+}
+
+// the validator runs on its clock only, orders are active and settled by the
+// clock time however far it is from the wall clock
+func TestValidatorManyRounds(t *testing.T) {
+	timing := DefaultTiming()
+	scheduler := NewScheduler(DefaultEpoch, timing, nil)
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := scheduler.Round(start) + 1
+	clock := NewManualClock(scheduler.RoundStart(first).Add(-time.Second))
+
+	v := newTestValidator(t, clock)
+	provider := newTestProvider(t, 0)
+	seedOrder(t, v.db, provider.nodeID, 0, clock.Now().Add(-time.Hour), 24*time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	waiting := clock.waiting()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v.Start(ctx)
+	}()
+	eventually(t, "scheduler", func() bool {
+		return clock.waiting() > waiting
+	})
+
+	const rounds = 200
+	begin := time.Now()
+	for round := first; round < first+rounds; round++ {
+		clock.Advance(scheduler.Event(round, PhasePrepare).At.Sub(clock.Now()))
+		eventually(t, "prepared round", func() bool {
+			return roundStatus(v.db, round) == database.RoundPrepared
+		})
+
+		clock.Advance(scheduler.Event(round, PhaseSettle).At.Sub(clock.Now()))
+		eventually(t, "settled round", func() bool {
+			return roundStatus(v.db, round) == database.RoundSettled
+		})
+	}
+	t.Logf("%d rounds in %s", rounds, time.Since(begin))
+
+	err := v.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	for round := first; round < first+rounds; round++ {
+		results, err := database.ListChallengeResultsByRoundTx(v.db, round)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].Success {
+			t.Fatalf("round %d: results %+v, want a miss of the node", round, results)
+		}
+	}
+
+	profit, err := database.GetProfitByAddressTx(v.db, provider.nodeID.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := scheduler.RoundStart(first + rounds - 1)
+	if !profit.LastTime.Equal(last) {
+		t.Errorf("provider settled at %s, want %s", profit.LastTime, last)
+	}
+	if profit.Balance.Sign() <= 0 || profit.Penalty.Sign() <= 0 {
+		t.Errorf("balance %s penalty %s after %d misses", profit.Balance, profit.Penalty, rounds)
+	}
+}
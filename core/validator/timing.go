@@ -0,0 +1,80 @@
+package validator
+
+import (
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Timing is the challenge timing, a cycle starts with the prepare window
+// followed by the prove window
+type Timing struct {
+	Prepare time.Duration
+	Prove   time.Duration
+	Cycle   time.Duration
+	Source  string // default或config
+}
+
+func DefaultTiming() Timing {
+	return Timing{
+		Prepare: 10 * time.Second,
+		Prove:   10 * time.Second,
+		Cycle:   2 * time.Minute,
+		Source:  "default",
+	}
+}
+
+func (t Timing) Validate() error {
+	if t.Prepare < time.Second || t.Prove < time.Second || t.Cycle < t.Prepare+t.Prove {
+		return xerrors.Errorf("timing prepare %s, prove %s and cycle %s is invalid", t.Prepare, t.Prove, t.Cycle)
+	}
+	if t.Prepare%time.Second != 0 || t.Prove%time.Second != 0 || t.Cycle%time.Second != 0 {
+		return xerrors.Errorf("timing prepare %s, prove %s and cycle %s must be whole seconds", t.Prepare, t.Prove, t.Cycle)
+	}
+
+	return nil
+}
+
+// TimingConfig is the timing in the config file in seconds, 0 means not set
+type TimingConfig struct {
+	Prepare int64 `json:"prepare"`
+	Prove   int64 `json:"prove"`
+	Cycle   int64 `json:"cycle"`
+}
+
+func (c TimingConfig) IsSet() bool {
+	return c.Prepare != 0 || c.Prove != 0 || c.Cycle != 0
+}
+
+// Timing returns the config timing, the fields not set keep their default values
+func (c TimingConfig) Timing() Timing {
+	timing := DefaultTiming()
+	timing.Source = "config"
+	if c.Prepare != 0 {
+		timing.Prepare = time.Duration(c.Prepare) * time.Second
+	}
+	if c.Prove != 0 {
+		timing.Prove = time.Duration(c.Prove) * time.Second
+	}
+	if c.Cycle != 0 {
+		timing.Cycle = time.Duration(c.Cycle) * time.Second
+	}
+
+	return timing
+}
+
+// LoadTiming reads the timing from the config and falls back to the default
+// timing. The market contract has no timing getters, so the timing is not
+// read from the chain.
+func LoadTiming(config TimingConfig) Timing {
+	if config.IsSet() {
+		timing := config.Timing()
+		err := timing.Validate()
+		if err == nil {
+			return timing
+		}
+		logger.Warnf("Invalid timing in config: %s", err.Error())
+	}
+
+	return DefaultTiming()
+}
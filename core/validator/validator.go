@@ -3,273 +3,822 @@ package validator
 import (
 	"context"
 	"crypto/ecdsa"
-	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"grid-prover/database"
 	"grid-prover/logs"
 	"math/big"
-	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"grid-prover/core/settlement"
 	"grid-prover/core/types"
+	"grid-prover/core/withdraw"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
 )
 
 var logger = logs.Logger("grid validator")
 
-// var proofChan = make(chan Proof, 100)
-var resultChan = make(chan types.Result, 100)
-var RND [32]byte
-
 type GRIDValidator struct {
-	last            int64
-	prepareInterval time.Duration
-	proveInterval   time.Duration
-	waitInterval    time.Duration
+	db *gorm.DB
+
+	timing    Timing
+	clock     Clock
+	scheduler *Scheduler
 
 	sk *ecdsa.PrivateKey
 
-	done  chan struct{}
-	doned bool
+	difficulty DifficultyPolicy
+	sampling   SamplingPolicy
+	penalty    settlement.Schedule
+	rnd        RNDSource
+	quorum     *Quorum // 为空表示单节点模式
+
+	signer       *withdraw.Signer
+	withdrawLock sync.Mutex
+
+	roundLock  sync.RWMutex
+	round      RoundState
+	closed     bool // 本轮已停止接收证明
+	challenged map[types.NodeID]bool
+	accepted   map[types.NodeID]types.Result
+
+	// proofLock is held by the proof handlers, the round is closed under the
+	// write lock so that the proofs in flight are drained before settlement
+	proofLock sync.RWMutex
+
+	// standby validators only serve the read-only endpoints
+	active atomic.Bool
+
+	runLock   sync.Mutex
+	stopOnce  sync.Once
+	abortOnce sync.Once
+	done      chan struct{} // closed by Stop, no new round is started
+	abort     chan struct{} // closed when Stop gives up waiting for the round
+	stopped   chan struct{} // closed when the running Start returns, nil before Start
 }
 
 func NewGRIDValidator(chain string, sk *ecdsa.PrivateKey) (*GRIDValidator, error) {
-	// get time information from contract
-	prepareInterval := 10 * time.Second
-	proveInterval := 10 * time.Second
-	waitInterval := 2*time.Minute - prepareInterval - proveInterval
-	return &GRIDValidator{
-		last:            0,
-		prepareInterval: prepareInterval,
-		proveInterval:   proveInterval,
-		waitInterval:    waitInterval,
+	// the timing can be replaced by SetTiming before Start
+	timing := DefaultTiming()
+	clock := SystemClock{}
+
+	signer, err := withdraw.NewSigner(withdraw.SchemeLegacy, nil, common.Address{})
+	if err != nil {
+		return nil, err
+	}
+
+	v := &GRIDValidator{
+		db: database.GlobalDataBase,
+
+		timing:    timing,
+		clock:     clock,
+		scheduler: NewScheduler(DefaultEpoch, timing, clock),
 
 		sk: sk,
 
+		difficulty: NewHardwareDifficulty(timing.Prepare / 2),
+		sampling:   AllNodes{},
+		penalty:    settlement.DefaultSchedule(settlement.DefaultPenaltyRate),
+		rnd:        CryptoRND{},
+		signer:     signer,
+
 		done:  make(chan struct{}),
-		doned: false,
-	}, nil
+		abort: make(chan struct{}),
+	}
+	v.active.Store(true)
+
+	return v, nil
+}
+
+// SetDatabase replaces the database opened by database.InitDatabase, e.g. to
+// run several validators in one process. It must be called before Start.
+func (v *GRIDValidator) SetDatabase(db *gorm.DB) {
+	v.db = db
+}
+
+func (v *GRIDValidator) SetPenaltySchedule(schedule settlement.Schedule) error {
+	err := schedule.Validate()
+	if err != nil {
+		return err
+	}
+
+	v.penalty = schedule
+	return nil
+}
+
+// SetTiming changes the challenge timing, it must be called before Start
+func (v *GRIDValidator) SetTiming(timing Timing) error {
+	err := timing.Validate()
+	if err != nil {
+		return err
+	}
+
+	v.timing = timing
+	v.scheduler = NewScheduler(DefaultEpoch, timing, v.clock)
+	if policy, ok := v.difficulty.(*HardwareDifficulty); ok {
+		policy.Target = timing.Prepare / 2
+	}
+
+	return nil
+}
+
+// Timing returns the challenge timing of the validator
+func (v *GRIDValidator) Timing() Timing {
+	return v.timing
+}
+
+// SetClock replaces the clock of the scheduler, it must be called before Start
+func (v *GRIDValidator) SetClock(clock Clock) {
+	v.clock = clock
+	v.scheduler = NewScheduler(DefaultEpoch, v.timing, clock)
 }
 
+func (v *GRIDValidator) SetSamplingPolicy(policy SamplingPolicy) {
+	v.sampling = policy
+}
+
+func (v *GRIDValidator) SetRNDSource(source RNDSource) {
+	v.rnd = source
+}
+
+func (v *GRIDValidator) SetWithdrawSigner(signer *withdraw.Signer) {
+	v.signer = signer
+}
+
+// SetActive switches the validator between active and standby, a standby
+// validator rejects proofs and withdraw requests
+func (v *GRIDValidator) SetActive(active bool) {
+	v.active.Store(active)
+}
+
+func (v *GRIDValidator) IsActive() bool {
+	return v.active.Load()
+}
+
+// challenge is the state of a prepared round
+type challenge struct {
+	round     database.ChallengeRound
+	resultMap map[types.NodeID]bool
+	skipped   map[types.NodeID]bool // 不结算的节点
+}
+
+// settled returns the results the orders are settled with, the schedule does
+// not penalize the orders in probation
+func (ch *challenge) settled() map[types.NodeID]bool {
+	var res = make(map[types.NodeID]bool, len(ch.resultMap))
+	for nodeID, result := range ch.resultMap {
+		if !ch.skipped[nodeID] {
+			res[nodeID] = result
+		}
+	}
+
+	return res
+}
+
+// Start runs the challenge rounds until ctx is done or Stop is called. After
+// Stop the round in flight is still settled, no new round is started. Start
+// can be called again after it returns, e.g. when a standby becomes leader.
 func (v *GRIDValidator) Start(ctx context.Context) {
-	for {
-		// 等待下一个prepare时期
-		wait, nextTime := v.CalculateWatingToPrepare()
+	stopped := make(chan struct{})
+	v.runLock.Lock()
+	v.stopped = stopped
+	v.runLock.Unlock()
+	defer close(stopped)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
 		select {
 		case <-ctx.Done():
-			v.doned = true
-			return
-		case <-v.done:
-			v.doned = true
-			return
-		case <-time.After(wait):
+		case <-v.abort:
+			cancel()
 		}
+	}()
 
-		err := v.GenerateRND(ctx)
-		if err != nil {
-			logger.Error(err.Error())
+	current, first := v.recoverRounds(ctx)
+	committed, commitTime := v.commitFirst(ctx, &first)
+	events := v.scheduler.Run(ctx, first)
+	done := v.done
+	stopping := false
+	for {
+		var event PhaseEvent
+		select {
+		case <-done:
+			done = nil
+			stopping = true
+			if current == nil {
+				return
+			}
+			logger.Infof("stopping, wait for round %d to settle", current.round.Round)
 			continue
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			event = e
 		}
 
-		// 等待下一个prove时期
-		wait, _ = v.CalculateWatingToProve()
-		select {
-		case <-ctx.Done():
-			return
-		case <-v.done:
-			v.doned = true
-			return
-		case <-time.After(wait):
-		}
+		switch event.Phase {
+		case PhasePrepare:
+			current = nil
+			if stopping {
+				return
+			}
 
-		resultMap, err := v.GetChallengeNode(ctx)
-		if err != nil {
-			logger.Error(err.Error())
-			continue
+			// 承诺必须在本轮开始前公布, 否则验证者可以选择随机数
+			if committed < event.Round || !commitTime.Before(v.scheduler.RoundStart(event.Round)) {
+				logger.Warnf("skip round %d, its rnd is not committed before it starts", event.Round)
+				continue
+			}
+
+			if !v.clock.Now().Before(event.ProveStart) {
+				logger.Warnf("skip round %d, its prepare window is over", event.Round)
+				continue
+			}
+
+			ch, err := v.prepareRound(ctx, event)
+			if err != nil {
+				logger.Error(err.Error())
+				continue
+			}
+			current = ch
+
+		case PhaseProve:
+			logger.Infof("round %d prove window starts", event.Round)
+
+		case PhaseSettle:
+			if current != nil && current.round.Round == event.Round {
+				v.settleRound(ctx, current, true)
+			}
+			current = nil
+			if stopping {
+				return
+			}
+
+			// 在下一个prepare时期前公布下一轮的承诺
+			commitment, err := v.CommitRND(ctx, event.Round+1)
+			if err != nil {
+				logger.Error(err.Error())
+				continue
+			}
+			committed = event.Round + 1
+			commitTime = v.publishTime(commitment)
 		}
+	}
+}
 
-		res, err := v.HandleResult(ctx, resultMap)
-		if err != nil {
-			logger.Error(err.Error())
-			continue
+// prepareRound reveals the rnd of the round and chooses the challenged nodes
+func (v *GRIDValidator) prepareRound(ctx context.Context, event PhaseEvent) (*challenge, error) {
+	err := v.GenerateRND(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+
+	state := v.CurrentRound()
+	round, err := database.GetChallengeRoundTx(v.db, state.Round)
+	if err != nil {
+		round = database.ChallengeRound{
+			Round:  state.Round,
+			Source: v.rnd.Name(),
 		}
+	}
+	round.StartTime = state.Start
+	round.RND = hex.EncodeToString(state.RND[:])
+	round.Reveal = hex.EncodeToString(state.Reveal)
+	round.Status = database.RoundPrepared
+	err = round.CreateChallengeRoundTx(v.db)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+
+	resultMap, err := v.GetChallengeNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	probation, err := v.GetProbationNode(ctx)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	for nodeID := range probation {
+		resultMap[nodeID] = false
+	}
+	v.setChallengeNode(state.Round, resultMap)
+
+	err = v.RecordChallengeNode(round, resultMap, probation)
+	if err != nil {
+		logger.Error(err.Error())
+	}
 
-		logger.Info("Start update profits")
-		err = v.AddPenalty(ctx, res)
+	return &challenge{
+		round:     round,
+		resultMap: resultMap,
+	}, nil
+}
+
+// settleRound settles the orders of the challenged nodes, live is false when
+// the round is settled after a restart and the accepted proofs are those
+// persisted in the database
+func (v *GRIDValidator) settleRound(ctx context.Context, ch *challenge, live bool) {
+	if live {
+		v.drainProofs(ch.round.Round)
+
+		_, err := v.HandleResult(ctx, ch.resultMap)
 		if err != nil {
 			logger.Error(err.Error())
-			continue
+			return
 		}
+	}
+
+	// the result of a closed round is final and served to the quorum
+	ch.round.Status = database.RoundClosed
+	err := v.RecordChallengeResult(&ch.round, ch.resultMap)
+	if err != nil {
+		logger.Error(err.Error())
+	}
 
-		v.last = nextTime
+	res := ch.settled()
+	if v.quorum != nil {
+		res = v.quorum.Agree(ctx, ch.round.Round, res)
+	}
+
+	logger.Info("Start update profits")
+	err = v.AddPenalty(ctx, ch.round.Round, ch.round.StartTime, res)
+	if err != nil {
+		logger.Error(err.Error())
+		return
 	}
-}
 
-func (v *GRIDValidator) Stop() {
-	close(v.done)
+	err = v.UpdateDiffcult(ctx, ch.resultMap)
+	if err != nil {
+		logger.Error(err.Error())
+	}
 
-	for !v.doned {
-		time.Sleep(200 * time.Millisecond)
+	ch.round.Status = database.RoundSettled
+	err = ch.round.UpdateChallengeRoundTx(v.db)
+	if err != nil {
+		logger.Error(err.Error())
 	}
 }
 
-func (v *GRIDValidator) IsProveTime() bool {
-	challengeCycleSeconds := int64((v.prepareInterval + v.proveInterval + v.waitInterval).Seconds())
-	now := time.Now().Unix()
-	duration := now - v.last
-	over := duration % challengeCycleSeconds
-	if over >= int64(v.prepareInterval.Seconds()) && over <= int64((v.prepareInterval+v.proveInterval).Seconds()) {
-		return true
+// Stop stops starting new rounds and waits for the round in flight to be
+// settled. When ctx is done first the round is abandoned, it is settled after
+// the next start. Pass a done ctx to stop without waiting.
+func (v *GRIDValidator) Stop(ctx context.Context) error {
+	v.stopOnce.Do(func() {
+		close(v.done)
+	})
+	v.runLock.Lock()
+	stopped := v.stopped
+	v.runLock.Unlock()
+	if stopped == nil {
+		return nil
+	}
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		v.abortOnce.Do(func() {
+			close(v.abort)
+		})
+		return ctx.Err()
 	}
+}
 
-	return false
+func (v *GRIDValidator) IsProveTime() bool {
+	return v.CurrentRound().InProveWindow(v.clock.Now())
 }
 
-func (v *GRIDValidator) CalculateWatingToPrepare() (time.Duration, int64) {
-	challengeCycleSeconds := int64((v.prepareInterval + v.proveInterval + v.waitInterval).Seconds())
-	now := time.Now().Unix()
-	duration := now - v.last
-	over := duration % challengeCycleSeconds
-	var waitingSeconds int64 = 0
-	if over >= int64(v.prepareInterval.Seconds()) {
-		waitingSeconds = challengeCycleSeconds - over
+// commitFirst publishes the commitment of the first round before it starts
+// and returns the last committed round with the time its commitment was
+// published. A round that already started is only joined if the rnd source
+// needs no commitment, otherwise first moves to the next round.
+func (v *GRIDValidator) commitFirst(ctx context.Context, first *PhaseEvent) (int64, time.Time) {
+	if first.Phase != PhasePrepare {
+		// the resumed round is revealed, the next round is committed when it settles
+		return first.Round, time.Time{}
+	}
+
+	commitment, err := v.CommitRND(ctx, first.Round)
+	if err != nil {
+		logger.Error(err.Error())
+		return first.Round - 1, time.Time{}
+	}
+	commitTime := v.publishTime(commitment)
+	if commitTime.Before(first.Start) {
+		return first.Round, commitTime
 	}
 
-	v.last = now - over
-	next := v.last + challengeCycleSeconds
+	logger.Warnf("skip round %d, it started before its rnd is committed", first.Round)
+	*first = v.scheduler.Event(first.Round+1, PhasePrepare)
+	commitment, err = v.CommitRND(ctx, first.Round)
+	if err != nil {
+		logger.Error(err.Error())
+		return first.Round - 1, time.Time{}
+	}
+	return first.Round, v.publishTime(commitment)
+}
 
-	return time.Duration(waitingSeconds) * time.Second, next
+// publishTime is the time a commitment returned by CommitRND is published. A
+// source without commitments has nothing to publish, any round can use it.
+func (v *GRIDValidator) publishTime(commitment []byte) time.Time {
+	if len(commitment) == 0 {
+		return time.Time{}
+	}
+	return v.clock.Now()
 }
 
-func (v *GRIDValidator) CalculateWatingToProve() (time.Duration, int64) {
-	challengeCycleSeconds := int64((v.prepareInterval + v.proveInterval + v.waitInterval).Seconds())
-	now := time.Now().Unix()
-	duration := now - v.last
-	over := duration % challengeCycleSeconds
-	var waitingSeconds int64 = 0
-	if over < int64(v.prepareInterval.Seconds()) {
-		waitingSeconds = int64(v.prepareInterval.Seconds()) - over
-		v.last = now - over
-	} else if over > int64((v.prepareInterval + v.proveInterval).Seconds()) {
-		waitingSeconds = challengeCycleSeconds + int64(v.prepareInterval.Seconds()) - over
-		v.last = now - over + challengeCycleSeconds
+// CommitRND publishes the rnd commitment of the round before it starts. A
+// published commitment is never replaced, otherwise a restart could choose
+// another rnd for the round.
+func (v *GRIDValidator) CommitRND(ctx context.Context, round int64) ([]byte, error) {
+	existing, err := database.GetChallengeRoundTx(v.db, round)
+	if err == nil && (existing.Commitment != "" || existing.Status != "") {
+		return nil, xerrors.Errorf("rnd of round %d is already committed", round)
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
 	}
 
-	next := v.last + challengeCycleSeconds
+	commitment, err := v.rnd.Commit(ctx, round)
+	if err != nil {
+		return nil, err
+	}
 
-	return time.Duration(waitingSeconds) * time.Second, next
+	challengeRound := database.ChallengeRound{
+		Round:      round,
+		Source:     v.rnd.Name(),
+		Commitment: hex.EncodeToString(commitment),
+	}
+	return commitment, challengeRound.CreateChallengeRoundTx(v.db)
 }
 
-func (v *GRIDValidator) GenerateRND(ctx context.Context) error {
-	// TODO: call the contract
-	for index := range RND {
-		RND[index] = byte(rand.Int())
+// GenerateRND reveals the rnd of the round of the prepare event
+func (v *GRIDValidator) GenerateRND(ctx context.Context, event PhaseEvent) error {
+	rnd, reveal, err := v.rnd.Reveal(ctx, event.Round)
+	if err != nil {
+		return err
 	}
 
+	v.setRound(RoundState{
+		Round:      event.Round,
+		RND:        rnd,
+		Reveal:     reveal,
+		Start:      event.Start,
+		ProveStart: event.ProveStart,
+		ProveEnd:   event.ProveEnd,
+	})
+
 	return nil
 }
 
+// GetChallengeNode returns the nodes with active orders chosen by the
+// sampling policy for the current round
 func (v *GRIDValidator) GetChallengeNode(ctx context.Context) (map[types.NodeID]bool, error) {
-	orders, err := database.ListAllActivedOrder()
+	candidates, err := v.challengeCandidates()
+	if err != nil {
+		return nil, err
+	}
+
+	state := v.CurrentRound()
+	nodes := v.sampling.Sample(state.Round, state.RND, candidates)
+	logger.Infof("challenge %d of %d nodes by %s", len(nodes), len(candidates), v.sampling.Name())
+
+	var resultMap = make(map[types.NodeID]bool, len(nodes))
+	for _, nodeID := range nodes {
+		resultMap[nodeID] = false
+	}
+
+	return resultMap, nil
+}
+
+// challengeCandidates returns the nodes with active orders, their order value
+// and challenge history
+func (v *GRIDValidator) challengeCandidates() ([]Candidate, error) {
+	orders, err := database.ListAllActivedOrderTx(v.db, v.clock.Now())
 	if err != nil {
 		return nil, err
 	}
 
-	var resultMap = make(map[types.NodeID]bool)
+	var since int64
+	if sampling, ok := v.sampling.(*WeightedSampling); ok {
+		since = v.CurrentRound().Round - sampling.Window
+	}
+	stats, err := database.ListNodeChallengeStatsTx(v.db, since)
+	if err != nil {
+		return nil, err
+	}
+	var history = make(map[types.NodeID]database.NodeChallengeStats, len(stats))
+	for _, stat := range stats {
+		history[types.NodeID{Address: stat.Address, ID: stat.Id}] = stat
+	}
+
+	var index = make(map[types.NodeID]int)
+	var candidates []Candidate
 	for _, order := range orders {
-		resultMap[types.NodeID{
+		nodeID := types.NodeID{
 			Address: order.Address,
 			ID:      order.Id,
-		}] = false
+		}
+
+		i, ok := index[nodeID]
+		if !ok {
+			i = len(candidates)
+			index[nodeID] = i
+			candidates = append(candidates, Candidate{
+				NodeID:    nodeID,
+				Value:     new(big.Int),
+				Failures:  history[nodeID].Failures,
+				LastRound: history[nodeID].LastRound,
+			})
+		}
+
+		node, err := database.GetNodeByAddressAndIdTx(v.db, order.Address, order.Id)
+		if err != nil {
+			logger.Warnf("Failed to get node %s-%d: %s", order.Address, order.Id, err.Error())
+			continue
+		}
+		value := node.Price()
+		value.Mul(value, big.NewInt(order.Duration))
+		candidates[i].Value.Add(candidates[i].Value, value)
 	}
 
-	return resultMap, nil
+	return candidates, nil
 }
 
-func (v *GRIDValidator) HandleResult(ctx context.Context, resultMap map[types.NodeID]bool) (map[types.NodeID]bool, error) {
-	var channel = make(chan struct{})
+// GetProbationNode returns the nodes whose orders are all in probation. They
+// are challenged so that users can judge them, but they are not penalized.
+// A node with an active order is not in probation even if it is not sampled.
+func (v *GRIDValidator) GetProbationNode(ctx context.Context) (map[types.NodeID]bool, error) {
+	now := v.clock.Now()
+	activeOrders, err := database.ListAllActivedOrderTx(v.db, now)
+	if err != nil {
+		return nil, err
+	}
+	var active = make(map[types.NodeID]bool, len(activeOrders))
+	for _, order := range activeOrders {
+		active[types.NodeID{Address: order.Address, ID: order.Id}] = true
+	}
 
-	logger.Info("start handle result")
-	go func() {
-		select {
-		case <-ctx.Done():
-			channel <- struct{}{}
-			return
-		case <-v.done:
-			channel <- struct{}{}
-			return
-		case <-time.After(v.proveInterval):
-			channel <- struct{}{}
-			return
+	orders, err := database.ListProbationOrdersTx(v.db, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var probation = make(map[types.NodeID]bool)
+	for _, order := range orders {
+		nodeID := types.NodeID{
+			Address: order.Address,
+			ID:      order.Id,
 		}
-	}()
+		if !active[nodeID] {
+			probation[nodeID] = true
+		}
+	}
 
-	for {
-		select {
-		case <-channel:
-			logger.Info("end handle result")
-			return resultMap, nil
-		case result := <-resultChan:
-			if _, ok := resultMap[result.NodeID]; ok {
-				resultMap[result.NodeID] = true
+	return probation, nil
+}
+
+// RecordChallengeNode stores the nodes challenged in the round, all of them
+// are failed until a proof is accepted
+func (v *GRIDValidator) RecordChallengeNode(round database.ChallengeRound, resultMap map[types.NodeID]bool, probation map[types.NodeID]bool) error {
+	var results = make([]database.ChallengeResult, 0, len(resultMap))
+	for nodeID := range resultMap {
+		results = append(results, database.ChallengeResult{
+			Round:     round.Round,
+			Address:   nodeID.Address,
+			Id:        nodeID.ID,
+			Probation: probation[nodeID],
+		})
+	}
+
+	return database.CreateChallengeResultsTx(v.db, results)
+}
+
+func (v *GRIDValidator) RecordChallengeResult(round *database.ChallengeRound, res map[types.NodeID]bool) error {
+	round.Nodes = int64(len(res))
+	round.Success = 0
+	for _, result := range res {
+		if result {
+			round.Success++
+		}
+	}
+
+	return round.UpdateChallengeRoundTx(v.db)
+}
+
+// HandleResult marks the nodes whose proof was accepted, it is called at the
+// settle phase when the prove window is over
+func (v *GRIDValidator) HandleResult(ctx context.Context, resultMap map[types.NodeID]bool) (map[types.NodeID]bool, error) {
+	round := v.CurrentRound().Round
+	logger.Info("start handle result")
+
+	for _, result := range v.acceptedProofs(round) {
+		if success, ok := resultMap[result.NodeID]; ok && !success {
+			resultMap[result.NodeID] = true
+
+			err := database.SetChallengeResultSuccessTx(v.db, round, result.Address, result.ID, result.Nonce, result.SubmitTime)
+			if err != nil {
+				logger.Error(err.Error())
 			}
 		}
 	}
 
-	// return resultMap, nil
+	logger.Info("end handle result")
+	return resultMap, nil
 }
 
-func (v *GRIDValidator) AddPenalty(ctx context.Context, res map[types.NodeID]bool) error {
-	for nodeID, result := range res {
+// AddPenalty settles the orders of each challenged node with the result of
+// that node, the profit of a provider is updated once from all of its nodes
+func (v *GRIDValidator) AddPenalty(ctx context.Context, round int64, start time.Time, res map[types.NodeID]bool) error {
+	providers := make(map[string][]types.NodeID)
+	for nodeID := range res {
+		providers[nodeID.Address] = append(providers[nodeID.Address], nodeID)
+	}
+
+	for address, nodeIDs := range providers {
+		sort.Slice(nodeIDs, func(i, j int) bool {
+			return nodeIDs[i].ID < nodeIDs[j].ID
+		})
 
-		profitInfo, err := database.GetProfitByAddress(nodeID.Address)
+		err := v.db.Transaction(func(tx *gorm.DB) error {
+			// the provider may be settled before a restart in the round
+			settled, err := database.IsProviderSettledTx(tx, round, address)
+			if err != nil {
+				return err
+			}
+			if settled {
+				return nil
+			}
+
+			released := new(big.Int)
+			for _, nodeID := range nodeIDs {
+				reward, err := v.settleOrders(tx, round, start, nodeID, res[nodeID])
+				if err != nil {
+					return err
+				}
+				released.Add(released, reward)
+			}
+
+			profitInfo, err := database.AggregateOrderProfitsTx(tx, address, released, start)
+			if err != nil {
+				return err
+			}
+			logger.Debugf("%s Balance: %d, Profit: %d, penalty: %d", address, profitInfo.Balance, profitInfo.Profit, profitInfo.Penalty)
+
+			return nil
+		})
 		if err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
+
+// settleOrders releases and penalizes each unsettled order of the node on its
+// own schedule and returns the profit released to the balance
+func (v *GRIDValidator) settleOrders(tx *gorm.DB, round int64, now time.Time, nodeID types.NodeID, success bool) (*big.Int, error) {
+	orders, err := database.ListUnsettledOrderProfitsTx(tx, nodeID.Address, nodeID.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	released := new(big.Int)
+	for _, order := range orders {
+		// an order is settled from its activation, its misses in probation are free
+		if order.ActivateTime.After(now) {
+			continue
+		}
 
-		var reward = new(big.Int)
-		if v.last <= profitInfo.LastTime.Unix() {
-			reward.SetInt64(0)
-		} else if v.last >= profitInfo.EndTime.Unix() {
-			reward.Set(profitInfo.Profit)
-		} else if profitInfo.LastTime.Unix() >= profitInfo.EndTime.Unix() {
-			reward.SetInt64(0)
-		} else {
-			reward.Mul(profitInfo.Profit, big.NewInt((v.last-profitInfo.LastTime.Unix())/(profitInfo.EndTime.Unix()-profitInfo.LastTime.Unix())))
+		account := settlement.Account{
+			Balance:  order.Released,
+			Profit:   order.Profit,
+			Penalty:  order.Penalty,
+			LastTime: order.LastTime,
+			EndTime:  order.EndTime,
 		}
-		// remain := profitInfo.Profit - reward
-		remain := new(big.Int).Sub(profitInfo.Profit, reward)
-		var penalty = big.NewInt(0)
-		if !result {
-			// penalty = remain / 100
-			penalty.Div(remain, big.NewInt(100))
+		total := new(big.Int).Add(order.Profit, order.Released)
+		total.Add(total, order.Penalty)
+
+		s, history := v.penalty.Settle(settlement.OrderState{
+			Account: account,
+			History: settlement.History{
+				Misses:      order.Misses,
+				Consecutive: order.Consecutive,
+			},
+			Activate: order.ActivateTime,
+			Start:    order.StartTime,
+			Total:    total,
+		}, now, success)
+
+		if v.penalty.DryRun && s.Fine.Sign() > 0 {
+			logger.Infof("dry run: order %d of node %s-%d would be charged %d after %d consecutive misses", order.OrderId, order.Address, order.NodeId, s.Fine, history.Consecutive)
+			s = settlement.Settle(account, now, true, settlement.PenaltyRate{})
 		}
 
-		profitInfo.LastTime = time.Unix(v.last, 0)
-		profitInfo.Balance.Add(profitInfo.Balance, reward)
-		profitInfo.Profit.Sub(remain, penalty)
-		profitInfo.Penalty.Add(profitInfo.Penalty, penalty)
-		logger.Debugf("Balance: %d, Profit: %d, penalty: %d", profitInfo.Balance, profitInfo.Profit, profitInfo.Penalty)
+		order.Released = s.Balance
+		order.Profit = s.Profit
+		order.Penalty = s.Penalty
+		order.LastTime = s.LastTime
+		order.Misses = history.Misses
+		order.Consecutive = history.Consecutive
+		err = order.UpdateOrderProfitTx(tx)
+		if err != nil {
+			return nil, err
+		}
 
-		err = profitInfo.UpdateProfit()
+		record := database.OrderSettlement{
+			Round:   round,
+			Address: order.Address,
+			NodeId:  order.NodeId,
+			OrderId: order.OrderId,
+			Success: success,
+			Reward:  s.Reward.String(),
+			Penalty: s.Fine.String(),
+		}
+		err = record.CreateOrderSettlementTx(tx)
 		if err != nil {
-			return err
+			return nil, err
 		}
+
+		released.Add(released, s.Reward)
 	}
 
-	return nil
+	return released, nil
 }
 
-func (v *GRIDValidator) GenerateWithdrawSignature(address string, amount *big.Int) ([]byte, error) {
-	profit, err := database.GetProfitByAddress(address)
+// GenerateWithdrawSignature signs a withdraw of amount at the current nonce of
+// the provider. auth is the signature of the provider over the WithdrawRequest.
+// Only one amount is signed for a nonce, it stays reserved until the Withdraw
+// event of the nonce arrives. A retry of the same amount gets the issued
+// signature again.
+func (v *GRIDValidator) GenerateWithdrawSignature(address string, amount *big.Int, auth []byte) ([]byte, error) {
+	v.withdrawLock.Lock()
+	defer v.withdrawLock.Unlock()
+
+	profit, err := database.GetProfitByAddressTx(v.db, address)
+	if err != nil {
+		return nil, err
+	}
+
+	request := types.WithdrawRequest{
+		Address: address,
+		Amount:  amount,
+		Nonce:   profit.Nonce,
+	}
+	publicKey, err := crypto.SigToPub(request.Hash(), auth)
+	if err != nil {
+		return nil, logs.AuthenticationFailed{Message: err.Error()}
+	}
+	if crypto.PubkeyToAddress(*publicKey) != common.HexToAddress(address) {
+		return nil, logs.AuthenticationFailed{Message: "withdraw request is not signed by the provider"}
+	}
+
+	if amount.Sign() <= 0 {
+		return nil, logs.BalanceError{Message: "withdraw amount must be positive"}
+	}
+	if amount.Cmp(profit.Balance) > 0 {
+		return nil, logs.BalanceError{Message: fmt.Sprintf("withdraw amount %s exceeds balance %s", amount, profit.Balance)}
+	}
+
+	pending, err := database.GetPendingWithdrawalTx(v.db, profit.Address, profit.Nonce)
+	if err == nil {
+		if pending.Amount == amount.String() {
+			return hex.DecodeString(pending.Signature)
+		}
+		return nil, logs.ConflictError{Message: fmt.Sprintf("withdraw of nonce %d is already signed", profit.Nonce)}
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	signature, err := v.signer.Sign(v.sk, common.HexToAddress(address), amount, profit.Nonce)
 	if err != nil {
 		return nil, err
 	}
 
-	var nonceBuf = make([]byte, 8)
-	binary.BigEndian.PutUint64(nonceBuf, profit.Nonce)
+	withdrawal := database.Withdrawal{
+		Address:   profit.Address,
+		Amount:    amount.String(),
+		Nonce:     profit.Nonce,
+		Signature: hex.EncodeToString(signature),
+		IssueTime: v.clock.Now(),
+		Status:    database.WithdrawalPending,
+	}
+	err = withdrawal.CreateWithdrawalTx(v.db)
+	if err != nil {
+		return nil, err
+	}
 
-	hash := crypto.Keccak256(common.FromHex(address), amount.Bytes(), nonceBuf)
-	return crypto.Sign(hash, v.sk)
+	return signature, nil
 }
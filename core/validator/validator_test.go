@@ -0,0 +1,518 @@
+package validator
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"grid-prover/core/client"
+	"grid-prover/core/types"
+	"grid-prover/database"
+	"math/big"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const testDifficulty = 4
+
+type testValidator struct {
+	*GRIDValidator
+	db     *gorm.DB
+	client *client.GRIDClient
+	url    string
+}
+
+// newTestValidator runs a validator with its own database and http server on
+// loopback, the rounds are driven by clock
+func newTestValidator(t *testing.T, clock Clock) *testValidator {
+	t.Helper()
+
+	db, err := database.OpenDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	// a write ahead log syncs less per commit, which keeps long runs fast
+	err = db.Exec("PRAGMA journal_mode = WAL").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sk, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewGRIDValidator("dev", sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.SetDatabase(db)
+	v.SetClock(clock)
+	v.SetDifficultyPolicy(FixedDifficulty(testDifficulty))
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	v.LoadValidatorModule(router.Group("/v1"))
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	url := server.URL + "/v1"
+	return &testValidator{
+		GRIDValidator: v,
+		db:            db,
+		client:        client.NewGRIDClient(url),
+		url:           url,
+	}
+}
+
+type testProvider struct {
+	sk     *ecdsa.PrivateKey
+	nodeID types.NodeID
+}
+
+func newTestProvider(t *testing.T, id int) testProvider {
+	t.Helper()
+
+	sk, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testProvider{
+		sk: sk,
+		nodeID: types.NodeID{
+			Address: crypto.PubkeyToAddress(sk.PublicKey).Hex(),
+			ID:      id,
+		},
+	}
+}
+
+// seedOrder stores the provider, its node and an order of the node running
+// from start for duration, as the dumper does for the chain events
+func seedOrder(t *testing.T, db *gorm.DB, nodeID types.NodeID, orderID uint64, start time.Time, duration time.Duration) {
+	t.Helper()
+
+	price := big.NewInt(1000)
+	profit := database.Profit{
+		Address:  nodeID.Address,
+		Balance:  big.NewInt(0),
+		Profit:   big.NewInt(0),
+		Penalty:  big.NewInt(0),
+		LastTime: start,
+		EndTime:  start.Add(duration),
+	}
+	node := database.Node{
+		Address:   nodeID.Address,
+		Id:        nodeID.ID,
+		CPUPrice:  price,
+		GPUPrice:  big.NewInt(0),
+		MemPrice:  big.NewInt(0),
+		DiskPrice: big.NewInt(0),
+	}
+	order := database.Order{
+		OrderId:      orderID,
+		Address:      nodeID.Address,
+		Id:           nodeID.ID,
+		ActivateTime: start,
+		Duration:     int64(duration.Seconds()),
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// the provider and the node may have other orders already
+		_, err := database.GetProfitByAddressTx(tx, nodeID.Address)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = profit.CreateProfitTx(tx)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = database.GetNodeByAddressAndIdTx(tx, nodeID.Address, nodeID.ID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = node.CreateNodeTx(tx)
+		}
+		if err != nil {
+			return err
+		}
+		err = order.CreateOrderTx(tx)
+		if err != nil {
+			return err
+		}
+
+		orderProfit := database.OrderProfit{
+			Address:      nodeID.Address,
+			NodeId:       nodeID.ID,
+			OrderId:      orderID,
+			Profit:       new(big.Int).Mul(price, big.NewInt(order.Duration)),
+			Released:     big.NewInt(0),
+			Penalty:      big.NewInt(0),
+			ActivateTime: order.ActivateTime,
+			StartTime:    order.StartTime,
+			LastTime:     order.StartTime,
+			EndTime:      order.EndTime,
+		}
+		return orderProfit.CreateOrderProfitTx(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// submitProof searches a nonce for the current round of the validator and
+// submits it signed by the provider
+func submitProof(ctx context.Context, c *client.GRIDClient, provider testProvider) error {
+	round, rnd, err := c.GetRoundRND(ctx)
+	if err != nil {
+		return err
+	}
+
+	diffcult, err := c.GetDifficulty(ctx, provider.nodeID)
+	if err != nil {
+		return err
+	}
+
+	proof := types.Proof{
+		NodeID: provider.nodeID,
+		Round:  round,
+	}
+	for !types.CheckPOWResult(proof.Hash(rnd), diffcult) {
+		proof.Nonce++
+	}
+
+	return c.SubmitSignedProof(ctx, proof, rnd, provider.sk)
+}
+
+// waiting returns the number of pending waiters of the clock
+func (c *ManualClock) waiting() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.waiters)
+}
+
+// eventually waits until cond holds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func roundStatus(db *gorm.DB, round int64) string {
+	challengeRound, err := database.GetChallengeRoundTx(db, round)
+	if err != nil {
+		return ""
+	}
+	return challengeRound.Status
+}
+
+// several validators run side by side in one process, each with its own round
+// state and database, while provers and readers hit them concurrently
+func TestValidatorsSideBySide(t *testing.T) {
+	timing := DefaultTiming()
+	scheduler := NewScheduler(DefaultEpoch, timing, nil)
+	first := scheduler.Round(time.Now()) + 1
+	clock := NewManualClock(scheduler.RoundStart(first).Add(-time.Second))
+
+	providers := []testProvider{newTestProvider(t, 1), newTestProvider(t, 2)}
+	var validators []*testValidator
+	for i := 0; i < 3; i++ {
+		v := newTestValidator(t, clock)
+		for j, provider := range providers {
+			seedOrder(t, v.db, provider.nodeID, uint64(j+1), clock.Now().Add(-time.Hour), 24*time.Hour)
+		}
+		validators = append(validators, v)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var running sync.WaitGroup
+	waiting := clock.waiting()
+	for _, v := range validators {
+		running.Add(1)
+		go func(v *testValidator) {
+			defer running.Done()
+			v.Start(ctx)
+		}(v)
+	}
+
+	eventually(t, "schedulers", func() bool {
+		return clock.waiting() >= waiting+len(validators)
+	})
+
+	const rounds = 4
+	for round := first; round < first+rounds; round++ {
+		clock.Advance(scheduler.Event(round, PhasePrepare).At.Sub(clock.Now()))
+		for _, v := range validators {
+			for _, provider := range providers {
+				eventually(t, "challenged nodes", func() bool {
+					return !errors.Is(v.checkProof(round, provider.nodeID), ErrNotChallenged) && v.CurrentRound().Round == round
+				})
+			}
+		}
+
+		clock.Advance(timing.Prepare)
+
+		// the second provider misses every other round
+		var wg sync.WaitGroup
+		errs := make(chan error, len(validators)*(len(providers)+1))
+		for _, v := range validators {
+			for i, provider := range providers {
+				if i == 1 && round%2 == 0 {
+					continue
+				}
+				wg.Add(1)
+				go func(v *testValidator, provider testProvider) {
+					defer wg.Done()
+					errs <- submitProof(ctx, v.client, provider)
+				}(v, provider)
+			}
+
+			wg.Add(1)
+			go func(v *testValidator) {
+				defer wg.Done()
+				_, _, err := v.client.GetRoundRND(ctx)
+				errs <- err
+			}(v)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		clock.Advance(timing.Prove)
+		for _, v := range validators {
+			eventually(t, "settlement", func() bool {
+				return roundStatus(v.db, round) == database.RoundSettled
+			})
+		}
+	}
+
+	for _, v := range validators {
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := v.Stop(stopCtx)
+		stopCancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	running.Wait()
+
+	for round := first; round < first+rounds; round++ {
+		rnds := make(map[string]bool)
+		for _, v := range validators {
+			challengeRound, err := database.GetChallengeRoundTx(v.db, round)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rnds[challengeRound.RND] = true
+
+			results, err := database.ListChallengeResultsByRoundTx(v.db, round)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != len(providers) {
+				t.Fatalf("round %d: %d results, want %d", round, len(results), len(providers))
+			}
+			for _, result := range results {
+				want := result.Address == providers[0].nodeID.Address || round%2 != 0
+				if result.Success != want {
+					t.Errorf("round %d: node %s success %v, want %v", round, result.Address, result.Success, want)
+				}
+			}
+		}
+		if len(rnds) != len(validators) {
+			t.Errorf("round %d: validators share the rnd", round)
+		}
+	}
+
+	// the missed rounds are penalized on the validator that saw them
+	for _, v := range validators {
+		profit, err := database.GetProfitByAddressTx(v.db, providers[1].nodeID.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if profit.Penalty.Sign() <= 0 {
+			t.Errorf("provider with missed rounds has penalty %s", profit.Penalty)
+		}
+		profit, err = database.GetProfitByAddressTx(v.db, providers[0].nodeID.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if profit.Penalty.Sign() != 0 || profit.Balance.Sign() <= 0 {
+			t.Errorf("provider without misses has balance %s penalty %s", profit.Balance, profit.Penalty)
+		}
+	}
+}
+
+// a node with an active order is not in probation, whether it is sampled or not
+func TestGetProbationNode(t *testing.T) {
+	now := time.Now()
+	v := newTestValidator(t, NewManualClock(now))
+
+	active := newTestProvider(t, 1)
+	probation := newTestProvider(t, 2)
+	seedOrder(t, v.db, active.nodeID, 1, now.Add(-time.Hour), 24*time.Hour)
+	for i, nodeID := range []types.NodeID{active.nodeID, probation.nodeID} {
+		order := database.Order{
+			OrderId:      uint64(10 + i),
+			Address:      nodeID.Address,
+			Id:           nodeID.ID,
+			ActivateTime: now.Add(-time.Minute),
+			Probation:    3600,
+			Duration:     3600,
+		}
+		err := order.CreateOrderTx(v.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nodes, err := v.GetProbationNode(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || !nodes[probation.nodeID] {
+		t.Errorf("probation nodes %v, want only %v", nodes, probation.nodeID)
+	}
+}
+
+// a miss of an order in its probation is counted only, a miss after the
+// probation is charged
+func TestSettleProbationOrder(t *testing.T) {
+	now := time.Unix(1_900_000_000, 0)
+	v := newTestValidator(t, NewManualClock(now))
+	provider := newTestProvider(t, 0)
+	seedOrder(t, v.db, provider.nodeID, 1, now.Add(-time.Hour), 24*time.Hour)
+
+	// the order starts an hour after the round of the first miss
+	orders, err := database.ListOrderProfitsByAddressTx(v.db, provider.nodeID.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := orders[0]
+	order.StartTime = now.Add(time.Hour)
+	order.LastTime = order.StartTime
+	err = order.UpdateOrderProfitTx(v.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		round   int64
+		at      time.Time
+		misses  int
+		charged bool
+	}{
+		{"miss in probation", 1, now, 1, false},
+		{"miss after probation", 2, now.Add(2 * time.Hour), 2, true},
+	}
+	for _, tt := range tests {
+		err := v.AddPenalty(context.Background(), tt.round, tt.at, map[types.NodeID]bool{provider.nodeID: false})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		orders, err := database.ListOrderProfitsByAddressTx(v.db, provider.nodeID.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if orders[0].Misses != tt.misses || (orders[0].Penalty.Sign() > 0) != tt.charged {
+			t.Errorf("%s: %d misses, penalty %s", tt.name, orders[0].Misses, orders[0].Penalty)
+		}
+	}
+}
+
+// Stop in the prove window waits for the round to be settled, or abandons it
+// to the next start when its ctx is done first
+func TestStopSettlesRound(t *testing.T) {
+	timing := DefaultTiming()
+	scheduler := NewScheduler(DefaultEpoch, timing, nil)
+
+	tests := []struct {
+		name   string
+		wait   bool
+		status string
+	}{
+		{"wait for the settle", true, database.RoundSettled},
+		{"deadline before the settle", false, database.RoundPrepared},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			round := scheduler.Round(time.Now()) + 1
+			clock := NewManualClock(scheduler.RoundStart(round).Add(-time.Second))
+			v := newTestValidator(t, clock)
+			proved, missed := newTestProvider(t, 0), newTestProvider(t, 0)
+			seedOrder(t, v.db, proved.nodeID, 1, clock.Now().Add(-time.Hour), 24*time.Hour)
+			seedOrder(t, v.db, missed.nodeID, 2, clock.Now().Add(-time.Hour), 24*time.Hour)
+
+			done := runValidator(t, v, clock)
+			clock.Advance(scheduler.Event(round, PhasePrepare).At.Sub(clock.Now()))
+			eventually(t, "prepared round", func() bool {
+				return roundStatus(v.db, round) == database.RoundPrepared && v.checkProof(round, proved.nodeID) == nil
+			})
+			clock.Advance(timing.Prepare)
+			err := submitProof(context.Background(), v.client, proved)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			if tt.wait {
+				ctx = context.Background()
+			}
+			stopped := make(chan error, 1)
+			go func() {
+				stopped <- v.Stop(ctx)
+			}()
+
+			if tt.wait {
+				select {
+				case err := <-stopped:
+					t.Fatalf("stopped before the settle: %v", err)
+				case <-time.After(100 * time.Millisecond):
+				}
+				clock.Advance(scheduler.Event(round, PhaseSettle).At.Sub(clock.Now()))
+			}
+
+			err = <-stopped
+			if (err == nil) != tt.wait {
+				t.Errorf("Stop() = %v", err)
+			}
+			<-done
+			if status := roundStatus(v.db, round); status != tt.status {
+				t.Fatalf("round is %q, want %q", status, tt.status)
+			}
+			if !tt.wait {
+				return
+			}
+
+			profit, err := database.GetProfitByAddressTx(v.db, missed.nodeID.Address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if profit.Penalty.Sign() <= 0 {
+				t.Errorf("node without a proof is not penalized when stopping")
+			}
+		})
+	}
+}
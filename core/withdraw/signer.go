@@ -0,0 +1,166 @@
+package withdraw
+
+import (
+	"crypto/ecdsa"
+	"encoding/binary"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/xerrors"
+)
+
+type Scheme string
+
+const (
+	// keccak256(address || amount.Bytes() || uint64 nonce), the original format
+	SchemeLegacy Scheme = "legacy"
+	// keccak256(abi.encodePacked(address cp, uint256 amount, uint256 nonce))
+	SchemePacked Scheme = "packed"
+	// the packed hash signed with the "\x19Ethereum Signed Message:\n32" prefix
+	SchemeEIP191 Scheme = "eip191"
+	// EIP-712 typed data Withdraw(address cp,uint256 amount,uint256 nonce)
+	SchemeEIP712 Scheme = "eip712"
+)
+
+const (
+	DefaultDomainName    = "Market"
+	DefaultDomainVersion = "1"
+)
+
+var (
+	eip712DomainTypeHash = crypto.Keccak256([]byte("EIP712Domain(string name,string version,uint256 chainId,address verifyingContract)"))
+	withdrawTypeHash     = crypto.Keccak256([]byte("Withdraw(address cp,uint256 amount,uint256 nonce)"))
+)
+
+type Signer struct {
+	scheme Scheme
+
+	// EIP-712 domain
+	name    string
+	version string
+	chainID *big.Int
+	market  common.Address
+}
+
+func NewSigner(scheme Scheme, chainID *big.Int, market common.Address) (*Signer, error) {
+	switch scheme {
+	case SchemeLegacy, SchemePacked, SchemeEIP191:
+	case SchemeEIP712:
+		if chainID == nil || chainID.Sign() <= 0 {
+			return nil, xerrors.Errorf("chain id is required by %s", scheme)
+		}
+	default:
+		return nil, xerrors.Errorf("unknown withdraw signature scheme %s", scheme)
+	}
+
+	if chainID == nil {
+		chainID = new(big.Int)
+	}
+
+	return &Signer{
+		scheme:  scheme,
+		name:    DefaultDomainName,
+		version: DefaultDomainVersion,
+		chainID: chainID,
+		market:  market,
+	}, nil
+}
+
+// SetDomain changes the name and version of the EIP-712 domain
+func (s *Signer) SetDomain(name, version string) {
+	s.name = name
+	s.version = version
+}
+
+func (s *Signer) Scheme() Scheme {
+	return s.scheme
+}
+
+// Hash returns the digest that is signed for a withdraw
+func (s *Signer) Hash(cp common.Address, amount *big.Int, nonce uint64) []byte {
+	switch s.scheme {
+	case SchemePacked:
+		return packedHash(cp, amount, nonce)
+	case SchemeEIP191:
+		return accounts.TextHash(packedHash(cp, amount, nonce))
+	case SchemeEIP712:
+		return crypto.Keccak256([]byte{0x19, 0x01}, s.DomainSeparator(), structHash(cp, amount, nonce))
+	default:
+		var nonceBuf = make([]byte, 8)
+		binary.BigEndian.PutUint64(nonceBuf, nonce)
+		return crypto.Keccak256(cp.Bytes(), amount.Bytes(), nonceBuf)
+	}
+}
+
+// DomainSeparator returns the EIP-712 domain separator of the Market contract
+func (s *Signer) DomainSeparator() []byte {
+	return crypto.Keccak256(
+		eip712DomainTypeHash,
+		crypto.Keccak256([]byte(s.name)),
+		crypto.Keccak256([]byte(s.version)),
+		common.LeftPadBytes(s.chainID.Bytes(), 32),
+		common.LeftPadBytes(s.market.Bytes(), 32),
+	)
+}
+
+// Sign signs the withdraw. Except for the legacy scheme, v is 27 or 28 as
+// expected by ecrecover in solidity.
+func (s *Signer) Sign(sk *ecdsa.PrivateKey, cp common.Address, amount *big.Int, nonce uint64) ([]byte, error) {
+	signature, err := crypto.Sign(s.Hash(cp, amount, nonce), sk)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.scheme != SchemeLegacy {
+		signature[crypto.RecoveryIDOffset] += 27
+	}
+	return signature, nil
+}
+
+// Recover returns the address that signed the withdraw, v can be 0/1 or 27/28
+func (s *Signer) Recover(cp common.Address, amount *big.Int, nonce uint64, signature []byte) (common.Address, error) {
+	if len(signature) != crypto.SignatureLength {
+		return common.Address{}, xerrors.Errorf("signature length %d is not %d", len(signature), crypto.SignatureLength)
+	}
+
+	sig := common.CopyBytes(signature)
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+
+	publicKey, err := crypto.SigToPub(s.Hash(cp, amount, nonce), sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	return crypto.PubkeyToAddress(*publicKey), nil
+}
+
+// Verify checks that the withdraw is signed by signer
+func (s *Signer) Verify(signer common.Address, cp common.Address, amount *big.Int, nonce uint64, signature []byte) bool {
+	recovered, err := s.Recover(cp, amount, nonce, signature)
+	if err != nil {
+		return false
+	}
+
+	return recovered == signer
+}
+
+func packedHash(cp common.Address, amount *big.Int, nonce uint64) []byte {
+	return crypto.Keccak256(
+		cp.Bytes(),
+		common.LeftPadBytes(amount.Bytes(), 32),
+		common.LeftPadBytes(new(big.Int).SetUint64(nonce).Bytes(), 32),
+	)
+}
+
+func structHash(cp common.Address, amount *big.Int, nonce uint64) []byte {
+	return crypto.Keccak256(
+		withdrawTypeHash,
+		common.LeftPadBytes(cp.Bytes(), 32),
+		common.LeftPadBytes(amount.Bytes(), 32),
+		common.LeftPadBytes(new(big.Int).SetUint64(nonce).Bytes(), 32),
+	)
+}
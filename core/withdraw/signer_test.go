@@ -0,0 +1,147 @@
+package withdraw
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// testdata/vectors.json is the output of `validator vectors` with the default
+// chain id and market, the solidity side checks against the same file
+func loadVectors(t *testing.T) []Vector {
+	t.Helper()
+
+	data, err := os.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var vectors []Vector
+	err = json.Unmarshal(data, &vectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) == 0 {
+		t.Fatal("no vectors")
+	}
+
+	return vectors
+}
+
+func TestVectorsGolden(t *testing.T) {
+	golden := loadVectors(t)
+
+	vectors, err := Vectors(big.NewInt(1), common.HexToAddress(golden[0].Market))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vectors, golden) {
+		t.Fatal("generated vectors differ from testdata/vectors.json")
+	}
+}
+
+func TestSignerVectors(t *testing.T) {
+	sk, err := crypto.HexToECDSA(vectorKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := common.HexToAddress("0x0000000000000000000000000000000000000002")
+
+	for _, v := range loadVectors(t) {
+		chainID, _ := new(big.Int).SetString(v.ChainID, 10)
+		amount, _ := new(big.Int).SetString(v.Amount, 10)
+		cp := common.HexToAddress(v.Cp)
+		signerAddress := common.HexToAddress(v.Signer)
+
+		s, err := NewSigner(v.Scheme, chainID, common.HexToAddress(v.Market))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := "0x" + hex.EncodeToString(s.Hash(cp, amount, v.Nonce)); got != v.Hash {
+			t.Errorf("%s %s/%d: hash %s, want %s", v.Scheme, v.Amount, v.Nonce, got, v.Hash)
+		}
+		if v.Scheme == SchemeEIP712 {
+			if got := "0x" + hex.EncodeToString(s.DomainSeparator()); got != v.DomainSeparator {
+				t.Errorf("domain separator %s, want %s", got, v.DomainSeparator)
+			}
+		}
+
+		signature, err := s.Sign(sk, cp, amount, v.Nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := "0x" + hex.EncodeToString(signature); got != v.Signature {
+			t.Errorf("%s %s/%d: signature %s, want %s", v.Scheme, v.Amount, v.Nonce, got, v.Signature)
+		}
+
+		golden, err := hex.DecodeString(v.Signature[2:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !s.Verify(signerAddress, cp, amount, v.Nonce, golden) {
+			t.Errorf("%s %s/%d: golden signature is not verified", v.Scheme, v.Amount, v.Nonce)
+		}
+		if s.Verify(other, cp, amount, v.Nonce, golden) {
+			t.Errorf("%s %s/%d: golden signature is verified for another signer", v.Scheme, v.Amount, v.Nonce)
+		}
+		if s.Verify(signerAddress, cp, new(big.Int).Add(amount, big.NewInt(1)), v.Nonce, golden) {
+			t.Errorf("%s %s/%d: golden signature is verified for another amount", v.Scheme, v.Amount, v.Nonce)
+		}
+	}
+}
+
+// the EIP-712 hash must match an independent typed data implementation
+func TestEIP712TypedData(t *testing.T) {
+	for _, v := range loadVectors(t) {
+		if v.Scheme != SchemeEIP712 {
+			continue
+		}
+
+		chainID, _ := new(big.Int).SetString(v.ChainID, 10)
+		amount, _ := new(big.Int).SetString(v.Amount, 10)
+		typedData := apitypes.TypedData{
+			Types: apitypes.Types{
+				"EIP712Domain": {
+					{Name: "name", Type: "string"},
+					{Name: "version", Type: "string"},
+					{Name: "chainId", Type: "uint256"},
+					{Name: "verifyingContract", Type: "address"},
+				},
+				"Withdraw": {
+					{Name: "cp", Type: "address"},
+					{Name: "amount", Type: "uint256"},
+					{Name: "nonce", Type: "uint256"},
+				},
+			},
+			PrimaryType: "Withdraw",
+			Domain: apitypes.TypedDataDomain{
+				Name:              DefaultDomainName,
+				Version:           DefaultDomainVersion,
+				ChainId:           (*math.HexOrDecimal256)(chainID),
+				VerifyingContract: v.Market,
+			},
+			Message: apitypes.TypedDataMessage{
+				"cp":     v.Cp,
+				"amount": amount.String(),
+				"nonce":  new(big.Int).SetUint64(v.Nonce).String(),
+			},
+		}
+
+		hash, _, err := apitypes.TypedDataAndHash(typedData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := "0x" + hex.EncodeToString(hash); got != v.Hash {
+			t.Errorf("%s/%d: typed data hash %s, want %s", v.Amount, v.Nonce, got, v.Hash)
+		}
+	}
+}
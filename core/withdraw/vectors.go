@@ -0,0 +1,83 @@
+package withdraw
+
+import (
+	"encoding/hex"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// the key of the vectors, never use it for anything else
+const vectorKey = "b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291"
+
+type Vector struct {
+	Scheme          Scheme `json:"scheme"`
+	ChainID         string `json:"chainId"`
+	Market          string `json:"market"`
+	DomainSeparator string `json:"domainSeparator,omitempty"`
+	Signer          string `json:"signer"`
+	Cp              string `json:"cp"`
+	Amount          string `json:"amount"`
+	Nonce           uint64 `json:"nonce"`
+	Hash            string `json:"hash"`
+	Signature       string `json:"signature"`
+}
+
+// Vectors returns withdraw signatures of a fixed key in every scheme, so that
+// the contract side can check its hashing and recovery against them.
+// Signatures are deterministic (RFC 6979). The vectors of chain id 1 and the
+// default market are kept in testdata/vectors.json, a change of the hashing
+// has to update that file on purpose.
+func Vectors(chainID *big.Int, market common.Address) ([]Vector, error) {
+	sk, err := crypto.HexToECDSA(vectorKey)
+	if err != nil {
+		return nil, err
+	}
+	signer := crypto.PubkeyToAddress(sk.PublicKey)
+
+	maxUint256 := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+	cases := []struct {
+		cp     common.Address
+		amount *big.Int
+		nonce  uint64
+	}{
+		{common.HexToAddress("0x867F691B053B61490F8eB74c2df63745CfC0A973"), big.NewInt(1), 0},
+		{common.HexToAddress("0x867F691B053B61490F8eB74c2df63745CfC0A973"), new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil), 1},
+		{common.HexToAddress("0x0000000000000000000000000000000000000001"), big.NewInt(256), 255},
+		{common.HexToAddress("0xffffffffffffffffffffffffffffffffffffffff"), maxUint256, ^uint64(0)},
+	}
+
+	var vectors []Vector
+	for _, scheme := range []Scheme{SchemeLegacy, SchemePacked, SchemeEIP191, SchemeEIP712} {
+		s, err := NewSigner(scheme, chainID, market)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range cases {
+			signature, err := s.Sign(sk, c.cp, c.amount, c.nonce)
+			if err != nil {
+				return nil, err
+			}
+
+			vector := Vector{
+				Scheme:    scheme,
+				ChainID:   s.chainID.String(),
+				Market:    market.Hex(),
+				Signer:    signer.Hex(),
+				Cp:        c.cp.Hex(),
+				Amount:    c.amount.String(),
+				Nonce:     c.nonce,
+				Hash:      "0x" + hex.EncodeToString(s.Hash(c.cp, c.amount, c.nonce)),
+				Signature: "0x" + hex.EncodeToString(signature),
+			}
+			if scheme == SchemeEIP712 {
+				vector.DomainSeparator = "0x" + hex.EncodeToString(s.DomainSeparator())
+			}
+			vectors = append(vectors, vector)
+		}
+	}
+
+	return vectors, nil
+}
@@ -0,0 +1,89 @@
+package database
+
+import "gorm.io/gorm"
+
+// ChainBlock is a block the dumper has processed, used to detect reorgs
+type ChainBlock struct {
+	Number     uint64 `gorm:"primaryKey;autoIncrement:false"`
+	Hash       string
+	ParentHash string
+}
+
+func InitChainBlock() error {
+	return GlobalDataBase.AutoMigrate(&ChainBlock{})
+}
+
+func (b *ChainBlock) SaveChainBlock() error {
+	return GlobalDataBase.Save(b).Error
+}
+
+func GetChainBlock(number uint64) (ChainBlock, error) {
+	var block ChainBlock
+	err := GlobalDataBase.Model(&ChainBlock{}).Where("number = ?", number).First(&block).Error
+	if err != nil {
+		return ChainBlock{}, err
+	}
+
+	return block, nil
+}
+
+// ListChainBlocks returns the stored blocks not after number, newest first
+func ListChainBlocks(number uint64) ([]ChainBlock, error) {
+	var blocks []ChainBlock
+	err := GlobalDataBase.Model(&ChainBlock{}).Where("number <= ?", number).Order("number desc").Find(&blocks).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+// PruneChainBlocks removes the blocks before number, they are too deep to be reorged
+func PruneChainBlocks(number uint64) error {
+	return GlobalDataBase.Where("number < ?", number).Delete(&ChainBlock{}).Error
+}
+
+// RollbackBlocks removes everything ingested from the blocks since number
+func RollbackBlocks(number uint64) error {
+	return GlobalDataBase.Transaction(func(tx *gorm.DB) error {
+		var changes []ProfitChange
+		err := tx.Model(&ProfitChange{}).Where("block_number >= ?", number).Order("id desc").Find(&changes).Error
+		if err != nil {
+			return err
+		}
+
+		for _, change := range changes {
+			err = revertProfitChange(tx, change)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = revertOrderProfits(tx, number)
+		if err != nil {
+			return err
+		}
+
+		err = rollbackWithdrawals(tx, number)
+		if err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{&ProcessedEvent{}, &ProfitChange{}, &OrderProfitStore{}, &Order{}, &NodeStore{}, &Provider{}} {
+			err = tx.Where("block_number >= ?", number).Delete(model).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.Where("number >= ?", number).Delete(&ChainBlock{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Save(&BlockNumber{
+			BlockNumberKey: blockNumberKey,
+			BlockNumber:    int64(number),
+		}).Error
+	})
+}
@@ -0,0 +1,159 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	RoundPrepared = "prepared" // 已生成随机数并选择挑战节点
+	RoundClosed   = "closed"   // prove时期已结束, 正在结算
+	RoundSettled  = "settled"  // 已结算
+)
+
+type ChallengeRound struct {
+	Round      int64     `gorm:"primaryKey;autoIncrement:false"` // 轮次
+	StartTime  time.Time // 本轮开始时间
+	RND        string    // 本轮随机数
+	Source     string    // 随机数来源
+	Commitment string    // prepare时期前公布的承诺
+	Reveal     string    // 用于验证随机数的揭示值
+	Nodes      int64     // 挑战节点数
+	Success    int64     // 提交证明成功的节点数
+	Status     string    `gorm:"index"` // 为空表示只公布了承诺
+}
+
+type ChallengeResult struct {
+	Round      int64  `gorm:"primaryKey;autoIncrement:false"`
+	Address    string `gorm:"primaryKey"`
+	Id         int    `gorm:"primaryKey;autoIncrement:false"`
+	Nonce      int64
+	SubmitTime time.Time // 证明提交时间
+	Success    bool
+	Probation  bool // 节点的订单处于试用期, 结果不计入惩罚
+}
+
+func InitChallenge() error {
+	return GlobalDataBase.AutoMigrate(&ChallengeRound{}, &ChallengeResult{})
+}
+
+func (r *ChallengeRound) CreateChallengeRoundTx(tx *gorm.DB) error {
+	return tx.Save(r).Error
+}
+
+func (r *ChallengeRound) UpdateChallengeRoundTx(tx *gorm.DB) error {
+	return tx.Model(&ChallengeRound{}).Where("round = ?", r.Round).Save(r).Error
+}
+
+func GetChallengeRoundTx(tx *gorm.DB, round int64) (ChallengeRound, error) {
+	var challengeRound ChallengeRound
+	err := tx.Model(&ChallengeRound{}).Where("round = ?", round).First(&challengeRound).Error
+	if err != nil {
+		return ChallengeRound{}, err
+	}
+
+	return challengeRound, nil
+}
+
+func ListChallengeRoundsTx(tx *gorm.DB, offset, limit int) ([]ChallengeRound, int64, error) {
+	var total int64
+	err := tx.Model(&ChallengeRound{}).Count(&total).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var rounds []ChallengeRound
+	err = tx.Model(&ChallengeRound{}).Order("round desc").Offset(offset).Limit(limit).Find(&rounds).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return rounds, total, nil
+}
+
+// ListUnsettledRoundsTx returns the prepared rounds that are not settled yet, oldest first
+func ListUnsettledRoundsTx(tx *gorm.DB) ([]ChallengeRound, error) {
+	var rounds []ChallengeRound
+	err := tx.Model(&ChallengeRound{}).Where("status IN ?", []string{RoundPrepared, RoundClosed}).Order("round").Find(&rounds).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return rounds, nil
+}
+
+func CreateChallengeResultsTx(tx *gorm.DB, results []ChallengeResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+	return tx.Save(&results).Error
+}
+
+// SetChallengeResultSuccessTx records an accepted proof of the node in the round
+func SetChallengeResultSuccessTx(tx *gorm.DB, round int64, address string, id int, nonce int64, submitTime time.Time) error {
+	return tx.Model(&ChallengeResult{}).Where("round = ? AND address = ? AND id = ?", round, address, id).Updates(map[string]interface{}{
+		"nonce":       nonce,
+		"submit_time": submitTime,
+		"success":     true,
+	}).Error
+}
+
+func ListChallengeResultsByRoundTx(tx *gorm.DB, round int64) ([]ChallengeResult, error) {
+	var results []ChallengeResult
+	err := tx.Model(&ChallengeResult{}).Where("round = ?", round).Order("address, id").Find(&results).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// ListProbationResultsByNodeTx returns the probation challenges of the node,
+// newest first
+func ListProbationResultsByNodeTx(tx *gorm.DB, address string, id int) ([]ChallengeResult, error) {
+	var results []ChallengeResult
+	err := tx.Model(&ChallengeResult{}).Where("address = ? AND id = ? AND probation = ?", address, id, true).Order("round desc").Find(&results).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+type NodeChallengeStats struct {
+	Address   string
+	Id        int
+	LastRound int64 // 上次被挑战的轮次
+	Failures  int64 // since之后的失败次数
+}
+
+// ListNodeChallengeStatsTx returns the last challenged round of every node and
+// its failures since the round
+func ListNodeChallengeStatsTx(tx *gorm.DB, since int64) ([]NodeChallengeStats, error) {
+	var stats []NodeChallengeStats
+	err := tx.Model(&ChallengeResult{}).
+		Select("address, id, MAX(round) AS last_round, SUM(CASE WHEN success = ? AND round >= ? THEN 1 ELSE 0 END) AS failures", false, since).
+		Group("address, id").Scan(&stats).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func ListChallengeResultsByNodeTx(tx *gorm.DB, address string, id int, offset, limit int) ([]ChallengeResult, int64, error) {
+	var total int64
+	err := tx.Model(&ChallengeResult{}).Where("address = ? AND id = ?", address, id).Count(&total).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var results []ChallengeResult
+	err = tx.Model(&ChallengeResult{}).Where("address = ? AND id = ?", address, id).Order("round desc").Offset(offset).Limit(limit).Find(&results).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return results, total, nil
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type NodeDifficulty struct {
+	Address     string `gorm:"primaryKey"`
+	Id          int    `gorm:"primaryKey;autoIncrement:false"`
+	Difficulty  int
+	AvgResponse int64 // 平均响应时间(毫秒)
+	Responses   int64 // 成功响应次数
+	UpdateTime  time.Time
+}
+
+func InitNodeDifficulty() error {
+	return GlobalDataBase.AutoMigrate(&NodeDifficulty{})
+}
+
+func GetNodeDifficultyTx(tx *gorm.DB, address string, id int) (NodeDifficulty, error) {
+	var difficulty NodeDifficulty
+	err := tx.Model(&NodeDifficulty{}).Where("address = ? AND id = ?", address, id).First(&difficulty).Error
+	if err != nil {
+		return NodeDifficulty{}, err
+	}
+
+	return difficulty, nil
+}
+
+// SetNodeDifficultyTx stores the difficulty of the node, keeping its response record
+func SetNodeDifficultyTx(tx *gorm.DB, address string, id int, difficulty int) error {
+	record := NodeDifficulty{
+		Address:    address,
+		Id:         id,
+		Difficulty: difficulty,
+		UpdateTime: time.Now(),
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "address"}, {Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"difficulty", "update_time"}),
+	}).Create(&record).Error
+}
+
+// RecordNodeResponseTx folds the response time of a successful proof into the
+// moving average of the node
+func RecordNodeResponseTx(tx *gorm.DB, address string, id int, response time.Duration) error {
+	record := NodeDifficulty{
+		Address:     address,
+		Id:          id,
+		AvgResponse: response.Milliseconds(),
+		Responses:   1,
+		UpdateTime:  time.Now(),
+	}
+	// avg = (3 * avg + response) / 4
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "address"}, {Name: "id"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "avg_response"}, Value: clause.Expr{SQL: "(3 * avg_response + ?) / 4", Vars: []interface{}{response.Milliseconds()}}},
+			{Column: clause.Column{Name: "responses"}, Value: clause.Expr{SQL: "responses + 1"}},
+			{Column: clause.Column{Name: "update_time"}, Value: record.UpdateTime},
+		},
+	}).Create(&record).Error
+}
@@ -0,0 +1,38 @@
+package database
+
+import "gorm.io/gorm"
+
+// ProcessedEvent marks a chain event whose changes are already in the database
+type ProcessedEvent struct {
+	TxHash      string `gorm:"primaryKey"`
+	LogIndex    uint   `gorm:"primaryKey;autoIncrement:false"`
+	BlockNumber uint64 `gorm:"index"`
+	Name        string
+}
+
+func InitProcessedEvent() error {
+	return GlobalDataBase.AutoMigrate(&ProcessedEvent{})
+}
+
+// ProcessEvent commits the writes of handle together with the record of the
+// event, an event that is already processed is skipped
+func ProcessEvent(event ProcessedEvent, handle func(tx *gorm.DB) error) error {
+	return GlobalDataBase.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&ProcessedEvent{}).Where("tx_hash = ? AND log_index = ?", event.TxHash, event.LogIndex).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			logger.Infof("Skip processed event %s %s-%d", event.Name, event.TxHash, event.LogIndex)
+			return nil
+		}
+
+		err = handle(tx)
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&event).Error
+	})
+}
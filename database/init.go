@@ -20,15 +20,28 @@ var GlobalDataBase *gorm.DB
 var logger = logs.Logger("database")
 
 func InitDatabase(path string) error {
-	dir, err := homedir.Expand(path)
+	db, err := OpenDatabase(path)
 	if err != nil {
 		return err
 	}
+	GlobalDataBase = db
+
+	logger.Info("init database success")
+	return nil
+}
+
+// OpenDatabase opens and migrates the database under path without setting
+// GlobalDataBase, every validator in a process can have its own database
+func OpenDatabase(path string) (*gorm.DB, error) {
+	dir, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
 
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		err := os.MkdirAll(dir, 0666)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -40,12 +53,12 @@ func InitDatabase(path string) error {
 
 	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "grid.db")), &gorm.Config{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	sqlDB, err := db.DB()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// 设置连接池中空闲连接的最大数量。
@@ -57,13 +70,19 @@ func InitDatabase(path string) error {
 
 	err = sqlDB.Ping()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	err = migrateKeys(db)
+	if err != nil {
+		return nil, err
 	}
-	db.AutoMigrate(&Order{}, &ProfitStore{}, &BlockNumber{}, &Provider{}, &NodeStore{})
-	GlobalDataBase = db
 
-	logger.Info("init database success")
-	return nil
+	err = db.AutoMigrate(&Order{}, &ProfitStore{}, &BlockNumber{}, &Provider{}, &NodeStore{}, &NodeDifficulty{}, &ChallengeRound{}, &ChallengeResult{}, &ChainBlock{}, &ProfitChange{}, &ProcessedEvent{}, &Withdrawal{}, &OrderProfitStore{}, &OrderSettlement{}, &Lease{})
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
 }
 
 func RemoveDataBase(path string) error {
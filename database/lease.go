@@ -0,0 +1,62 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Lease is held by the leader of the validators sharing the database, it has
+// to be renewed before it expires
+type Lease struct {
+	Name    string `gorm:"primaryKey"`
+	Holder  string
+	Expires int64 // 过期时间, unix毫秒
+}
+
+// AcquireLeaseTx takes the lease for holder if it is free, expired or already
+// held by holder, and extends it to now+ttl. It reports whether holder owns
+// the lease afterwards.
+func AcquireLeaseTx(tx *gorm.DB, name, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	expires := now.Add(ttl).UnixMilli()
+
+	res := tx.Model(&Lease{}).
+		Where("name = ? AND (holder = ? OR expires < ?)", name, holder, now.UnixMilli()).
+		Updates(map[string]interface{}{"holder": holder, "expires": expires})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected > 0 {
+		return true, nil
+	}
+
+	// 租约不存在时创建, 并发创建时只有一个成功
+	lease := Lease{
+		Name:    name,
+		Holder:  holder,
+		Expires: expires,
+	}
+	res = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&lease)
+	if res.Error != nil {
+		return false, res.Error
+	}
+
+	return res.RowsAffected > 0, nil
+}
+
+// ReleaseLeaseTx expires the lease if it is held by holder, so that a standby
+// can take it over without waiting
+func ReleaseLeaseTx(tx *gorm.DB, name, holder string) error {
+	return tx.Model(&Lease{}).Where("name = ? AND holder = ?", name, holder).Update("expires", 0).Error
+}
+
+func GetLeaseTx(tx *gorm.DB, name string) (Lease, error) {
+	var lease Lease
+	err := tx.Model(&Lease{}).Where("name = ?", name).First(&lease).Error
+	if err != nil {
+		return Lease{}, err
+	}
+
+	return lease, nil
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+type columnInfo struct {
+	Name string
+	Pk   int
+}
+
+// migrateKeys moves the tables created by older versions to their current
+// primary keys before AutoMigrate, which can not change the primary key of
+// an existing sqlite table
+func migrateKeys(db *gorm.DB) error {
+	// orders were keyed by an auto increment node id, that key is the only
+	// unique value of the old rows and is kept as their order id
+	err := rebuildTable(db, &Order{}, "orders", []string{"order_id"}, map[string]string{"order_id": "`id`"})
+	if err != nil {
+		return err
+	}
+
+	// nodes were keyed by an auto increment id, so two providers could not
+	// have the same node id
+	return rebuildTable(db, &NodeStore{}, "node_stores", []string{"address", "id"}, nil)
+}
+
+// rebuildTable recreates table for model if its primary key is not keys and
+// copies the rows over. fill gives the select expressions of the new columns
+// that the old table does not have.
+func rebuildTable(db *gorm.DB, model interface{}, table string, keys []string, fill map[string]string) error {
+	if !db.Migrator().HasTable(table) {
+		return nil
+	}
+
+	columns, err := tableColumns(db, table)
+	if err != nil {
+		return err
+	}
+	if primaryKeys(columns) == strings.Join(keys, ",") {
+		return nil
+	}
+
+	logger.Infof("Rebuild table %s with primary key %v", table, keys)
+	return db.Transaction(func(tx *gorm.DB) error {
+		legacy := table + "_legacy"
+		err := tx.Migrator().RenameTable(table, legacy)
+		if err != nil {
+			return err
+		}
+
+		// the indexes keep their names after the rename
+		var indexes []string
+		err = tx.Raw("SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL", legacy).Scan(&indexes).Error
+		if err != nil {
+			return err
+		}
+		for _, index := range indexes {
+			err = tx.Exec(fmt.Sprintf("DROP INDEX `%s`", index)).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.Migrator().CreateTable(model)
+		if err != nil {
+			return err
+		}
+
+		created, err := tableColumns(tx, table)
+		if err != nil {
+			return err
+		}
+		old := make(map[string]bool)
+		for _, column := range columns {
+			old[column.Name] = true
+		}
+
+		var names, values []string
+		for _, column := range created {
+			if value, ok := fill[column.Name]; ok {
+				names = append(names, "`"+column.Name+"`")
+				values = append(values, value)
+			} else if old[column.Name] {
+				names = append(names, "`"+column.Name+"`")
+				values = append(values, "`"+column.Name+"`")
+			}
+		}
+
+		err = tx.Exec(fmt.Sprintf("INSERT INTO `%s` (%s) SELECT %s FROM `%s`", table, strings.Join(names, ","), strings.Join(values, ","), legacy)).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Migrator().DropTable(legacy)
+	})
+}
+
+func tableColumns(db *gorm.DB, table string) ([]columnInfo, error) {
+	var columns []columnInfo
+	err := db.Raw(fmt.Sprintf("PRAGMA table_info(`%s`)", table)).Scan(&columns).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return columns, nil
+}
+
+// primaryKeys returns the primary key columns in key order
+func primaryKeys(columns []columnInfo) string {
+	keys := make([]string, len(columns))
+	n := 0
+	for _, column := range columns {
+		if column.Pk > 0 && column.Pk <= len(keys) {
+			keys[column.Pk-1] = column.Name
+			n++
+		}
+	}
+
+	return strings.Join(keys[:n], ",")
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// the tables as created by older versions
+var legacyTables = []string{
+	"CREATE TABLE `orders` (`address` text,`id` integer PRIMARY KEY AUTOINCREMENT,`activate` datetime,`start` datetime,`end` datetime,`probation` integer,`duration` integer)",
+	"CREATE TABLE `node_stores` (`address` text,`id` integer PRIMARY KEY AUTOINCREMENT,`cpu_price` text,`cpu_model` text,`gpu_price` text,`gpu_model` text,`mem_price` text,`mem_capacity` integer,`disk_price` text,`disk_capacity` integer,`block_number` integer)",
+	"CREATE INDEX `idx_node_stores_block_number` ON `node_stores`(`block_number`)",
+	"INSERT INTO `orders` (`address`,`id`,`probation`,`duration`) VALUES ('0x01',3,10,100)",
+	"INSERT INTO `node_stores` (`address`,`id`,`cpu_price`,`block_number`) VALUES ('0x01',1,'10',7)",
+}
+
+func TestOpenDatabaseMigratesKeys(t *testing.T) {
+	dir := t.TempDir()
+	legacy, err := gorm.Open(sqlite.Open(filepath.Join(dir, "grid.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sql := range legacyTables {
+		err = legacy.Exec(sql).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sqlDB, _ := legacy.DB()
+	sqlDB.Close()
+
+	db, err := OpenDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ = db.DB()
+	defer sqlDB.Close()
+
+	// the tables after the rebuilt ones are migrated too
+	if !db.Migrator().HasTable(&Lease{}) {
+		t.Fatal("leases is not created")
+	}
+
+	var order Order
+	err = db.Where("order_id = ?", 3).First(&order).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Address != "0x01" || order.Id != 3 || order.Duration != 100 {
+		t.Errorf("order is not copied: %+v", order)
+	}
+
+	var stored NodeStore
+	err = db.Where("address = ? AND id = ?", "0x01", 1).First(&stored).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.CPUPrice != "10" || stored.BlockNumber != 7 {
+		t.Errorf("node is not copied: %+v", stored)
+	}
+
+	// node and order ids come from the chain and may be zero or shared
+	for _, address := range []string{"0x01", "0x02"} {
+		err = db.Create(&NodeStore{Address: address, Id: 0}).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var count int64
+	db.Model(&NodeStore{}).Where("id = ?", 0).Count(&count)
+	if count != 2 {
+		t.Errorf("%d nodes with id 0, want 2", count)
+	}
+
+	err = db.Create(&Order{OrderId: 0, Address: "0x02"}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zero Order
+	err = db.Where("order_id = ?", 0).First(&zero).Error
+	if err != nil || zero.Address != "0x02" {
+		t.Errorf("order 0 is not stored: %+v %v", zero, err)
+	}
+
+	// a migrated database is opened again without a rebuild
+	sqlDB.Close()
+	db, err = OpenDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ = db.DB()
+	db.Model(&NodeStore{}).Count(&count)
+	if count != 3 {
+		t.Errorf("%d nodes after reopen, want 3", count)
+	}
+}
@@ -1,8 +1,13 @@
 package database
 
-import "time"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type Order struct {
+	OrderId      uint64 `gorm:"primaryKey;autoIncrement:false"` // 合约中的订单id
 	Address      string
 	Id           int
 	ActivateTime time.Time `gorm:"column:activate"`
@@ -10,6 +15,8 @@ type Order struct {
 	EndTime      time.Time `gorm:"column:end"`
 	Probation    int64
 	Duration     int64
+
+	BlockNumber uint64 `gorm:"index"` // 创建订单事件所在区块
 }
 
 func InitOrder() error {
@@ -17,9 +24,13 @@ func InitOrder() error {
 }
 
 func (o *Order) CreateOrder() error {
+	return o.CreateOrderTx(GlobalDataBase)
+}
+
+func (o *Order) CreateOrderTx(tx *gorm.DB) error {
 	o.StartTime = o.ActivateTime.Add(time.Duration(o.Probation) * time.Second)
 	o.EndTime = o.StartTime.Add(time.Duration(o.Duration) * time.Second)
-	return GlobalDataBase.Create(o).Error
+	return tx.Create(o).Error
 }
 
 func GetOrderByAddressAndId(address string, id int64) (Order, error) {
@@ -32,10 +43,26 @@ func GetOrderByAddressAndId(address string, id int64) (Order, error) {
 	return order, nil
 }
 
-func ListAllActivedOrder() ([]Order, error) {
-	var now = time.Now()
+// ListAllActivedOrder returns the orders started and not ended at now
+func ListAllActivedOrder(now time.Time) ([]Order, error) {
+	return ListAllActivedOrderTx(GlobalDataBase, now)
+}
+
+func ListAllActivedOrderTx(tx *gorm.DB, now time.Time) ([]Order, error) {
+	var orders []Order
+	err := tx.Model(&Order{}).Where("start < ? AND end > ?", now, now).Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+// ListProbationOrdersTx returns the orders that are activated but still in
+// probation at now, the user can cancel them until they start
+func ListProbationOrdersTx(tx *gorm.DB, now time.Time) ([]Order, error) {
 	var orders []Order
-	err := GlobalDataBase.Model(&Order{}).Where("start < ? AND end > ?", now, now).Find(&orders).Error
+	err := tx.Model(&Order{}).Where("activate < ? AND start > ?", now, now).Find(&orders).Error
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,227 @@
+package database
+
+import (
+	"errors"
+	"math/big"
+	"time"
+
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// OrderProfit is the profit of a single order, it is released and penalized
+// on the schedule of the order
+type OrderProfit struct {
+	Address      string // CPU/GPU供应商ID
+	NodeId       int
+	OrderId      uint64
+	Profit       *big.Int  // 未释放的分润值
+	Released     *big.Int  // 已释放到余额的分润值
+	Penalty      *big.Int  // 惩罚值
+	ActivateTime time.Time // 订单激活时间, 试用期开始
+	StartTime    time.Time // 订单开始时间
+	LastTime     time.Time // 上次结算时间
+	EndTime      time.Time // 订单结束时间
+
+	Misses      int // 挑战失败次数
+	Consecutive int // 连续挑战失败次数
+
+	BlockNumber uint64 // 创建订单事件所在区块
+}
+
+type OrderProfitStore struct {
+	Address      string `gorm:"primaryKey"`
+	NodeId       int    `gorm:"primaryKey;autoIncrement:false"`
+	OrderId      uint64 `gorm:"primaryKey;autoIncrement:false"`
+	Profit       string
+	Released     string
+	Penalty      string
+	ActivateTime time.Time
+	StartTime    time.Time
+	LastTime     time.Time
+	EndTime      time.Time `gorm:"index"`
+
+	Misses      int
+	Consecutive int
+
+	BlockNumber uint64 `gorm:"index"`
+}
+
+func InitOrderProfit() error {
+	return GlobalDataBase.AutoMigrate(&OrderProfitStore{})
+}
+
+func (p *OrderProfit) store() *OrderProfitStore {
+	return &OrderProfitStore{
+		Address:      p.Address,
+		NodeId:       p.NodeId,
+		OrderId:      p.OrderId,
+		Profit:       p.Profit.String(),
+		Released:     p.Released.String(),
+		Penalty:      p.Penalty.String(),
+		ActivateTime: p.ActivateTime,
+		StartTime:    p.StartTime,
+		LastTime:     p.LastTime,
+		EndTime:      p.EndTime,
+		Misses:       p.Misses,
+		Consecutive:  p.Consecutive,
+		BlockNumber:  p.BlockNumber,
+	}
+}
+
+func (p *OrderProfit) CreateOrderProfitTx(tx *gorm.DB) error {
+	return tx.Create(p.store()).Error
+}
+
+// UpdateOrderProfitTx updates all the fields of the order, Save would insert
+// it again when the node id or order id is 0
+func (p *OrderProfit) UpdateOrderProfitTx(tx *gorm.DB) error {
+	return tx.Model(&OrderProfitStore{}).Where("address = ? AND node_id = ? AND order_id = ?", p.Address, p.NodeId, p.OrderId).Select("*").Updates(p.store()).Error
+}
+
+func (s OrderProfitStore) load() (OrderProfit, error) {
+	var profit = OrderProfit{
+		Address:      s.Address,
+		NodeId:       s.NodeId,
+		OrderId:      s.OrderId,
+		Profit:       new(big.Int),
+		Released:     new(big.Int),
+		Penalty:      new(big.Int),
+		ActivateTime: s.ActivateTime,
+		StartTime:    s.StartTime,
+		LastTime:     s.LastTime,
+		EndTime:      s.EndTime,
+		Misses:       s.Misses,
+		Consecutive:  s.Consecutive,
+		BlockNumber:  s.BlockNumber,
+	}
+
+	_, ok := profit.Profit.SetString(s.Profit, 10)
+	if !ok {
+		return OrderProfit{}, xerrors.Errorf("Profit %s is not in decimal format", s.Profit)
+	}
+
+	_, ok = profit.Released.SetString(s.Released, 10)
+	if !ok {
+		return OrderProfit{}, xerrors.Errorf("Released %s is not in decimal format", s.Released)
+	}
+
+	_, ok = profit.Penalty.SetString(s.Penalty, 10)
+	if !ok {
+		return OrderProfit{}, xerrors.Errorf("Penalty %s is not in decimal format", s.Penalty)
+	}
+
+	return profit, nil
+}
+
+func loadOrderProfits(stores []OrderProfitStore) ([]OrderProfit, error) {
+	var profits = make([]OrderProfit, 0, len(stores))
+	for _, store := range stores {
+		profit, err := store.load()
+		if err != nil {
+			return nil, err
+		}
+		profits = append(profits, profit)
+	}
+
+	return profits, nil
+}
+
+func ListOrderProfitsByAddressTx(tx *gorm.DB, address string) ([]OrderProfit, error) {
+	var stores []OrderProfitStore
+	err := tx.Model(&OrderProfitStore{}).Where("address = ?", address).Order("order_id").Find(&stores).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return loadOrderProfits(stores)
+}
+
+// ListUnsettledOrderProfitsTx returns the orders of the node whose profit is
+// not fully released yet
+func ListUnsettledOrderProfitsTx(tx *gorm.DB, address string, nodeId int) ([]OrderProfit, error) {
+	var stores []OrderProfitStore
+	err := tx.Model(&OrderProfitStore{}).Where("address = ? AND node_id = ? AND last_time < end_time", address, nodeId).Order("order_id").Find(&stores).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return loadOrderProfits(stores)
+}
+
+// revertOrderProfits takes back what the settlement moved out of the orders
+// created since number. Reverting the CreateOrder change removes the whole
+// order value from the profit, but the released part is in the balance and
+// the penalty is in the penalty by now.
+func revertOrderProfits(tx *gorm.DB, number uint64) error {
+	var stores []OrderProfitStore
+	err := tx.Model(&OrderProfitStore{}).Where("block_number >= ?", number).Find(&stores).Error
+	if err != nil {
+		return err
+	}
+
+	orders, err := loadOrderProfits(stores)
+	if err != nil {
+		return err
+	}
+
+	for _, order := range orders {
+		if order.Released.Sign() == 0 && order.Penalty.Sign() == 0 {
+			continue
+		}
+
+		profit, err := GetProfitByAddressTx(tx, order.Address)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// the provider is rolled back as well
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		profit.Balance.Sub(profit.Balance, order.Released)
+		profit.Penalty.Sub(profit.Penalty, order.Penalty)
+		profit.Profit.Add(profit.Profit, order.Released)
+		profit.Profit.Add(profit.Profit, order.Penalty)
+		err = profit.UpdateProfitTx(tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AggregateOrderProfitsTx sets Profit, Penalty and EndTime of the provider
+// from its orders and adds released to its balance, now is the settle time
+func AggregateOrderProfitsTx(tx *gorm.DB, address string, released *big.Int, now time.Time) (Profit, error) {
+	profit, err := GetProfitByAddressTx(tx, address)
+	if err != nil {
+		return Profit{}, err
+	}
+
+	var stores []OrderProfitStore
+	err = tx.Model(&OrderProfitStore{}).Where("address = ?", address).Find(&stores).Error
+	if err != nil {
+		return Profit{}, err
+	}
+
+	orders, err := loadOrderProfits(stores)
+	if err != nil {
+		return Profit{}, err
+	}
+
+	profit.Profit = new(big.Int)
+	profit.Penalty = new(big.Int)
+	for _, order := range orders {
+		profit.Profit.Add(profit.Profit, order.Profit)
+		profit.Penalty.Add(profit.Penalty, order.Penalty)
+		if order.EndTime.After(profit.EndTime) {
+			profit.EndTime = order.EndTime
+		}
+	}
+	profit.Balance.Add(profit.Balance, released)
+	profit.LastTime = now
+
+	return profit, profit.UpdateProfitTx(tx)
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"golang.org/x/xerrors"
+	"gorm.io/gorm"
 )
 
 type Profit struct {
@@ -33,6 +34,10 @@ func InitProfit() error {
 }
 
 func (p *Profit) CreateProfit() error {
+	return p.CreateProfitTx(GlobalDataBase)
+}
+
+func (p *Profit) CreateProfitTx(tx *gorm.DB) error {
 	profit := &ProfitStore{
 		Address:  p.Address,
 		Balance:  p.Balance.String(),
@@ -40,11 +45,16 @@ func (p *Profit) CreateProfit() error {
 		Penalty:  p.Penalty.String(),
 		LastTime: p.LastTime,
 		EndTime:  p.EndTime,
+		Nonce:    p.Nonce,
 	}
-	return GlobalDataBase.Create(profit).Error
+	return tx.Create(profit).Error
 }
 
 func (p *Profit) UpdateProfit() error {
+	return p.UpdateProfitTx(GlobalDataBase)
+}
+
+func (p *Profit) UpdateProfitTx(tx *gorm.DB) error {
 	profit := &ProfitStore{
 		Address:  p.Address,
 		Balance:  p.Balance.String(),
@@ -52,21 +62,30 @@ func (p *Profit) UpdateProfit() error {
 		Penalty:  p.Penalty.String(),
 		LastTime: p.LastTime,
 		EndTime:  p.EndTime,
+		Nonce:    p.Nonce,
 	}
-	return GlobalDataBase.Model(&ProfitStore{}).Where("address = ?", p.Address).Save(profit).Error
+	return tx.Model(&ProfitStore{}).Where("address = ?", p.Address).Save(profit).Error
 }
 
 func GetProfitByAddress(address string) (Profit, error) {
+	return GetProfitByAddressTx(GlobalDataBase, address)
+}
+
+func GetProfitByAddressTx(tx *gorm.DB, address string) (Profit, error) {
 	var profitStore ProfitStore
-	err := GlobalDataBase.Model(&ProfitStore{}).Where("address = ?", address).First(&profitStore).Error
+	err := tx.Model(&ProfitStore{}).Where("address = ?", address).First(&profitStore).Error
 	if err != nil {
 		return Profit{}, err
 	}
 
 	var profit = Profit{
 		Address:  profitStore.Address,
+		Balance:  new(big.Int),
+		Profit:   new(big.Int),
+		Penalty:  new(big.Int),
 		LastTime: profitStore.LastTime,
 		EndTime:  profitStore.EndTime,
+		Nonce:    profitStore.Nonce,
 	}
 
 	_, ok := profit.Balance.SetString(profitStore.Balance, 10)
@@ -87,6 +106,71 @@ func GetProfitByAddress(address string) (Profit, error) {
 	return profit, nil
 }
 
+// ProfitChange records how a chain event changed a profit, so that the change
+// can be reverted when the block of the event is orphaned
+type ProfitChange struct {
+	Id          uint   `gorm:"primaryKey"`
+	BlockNumber uint64 `gorm:"index"`
+	Address     string
+	Created     bool      // 该事件创建了分润记录
+	Balance     string    // 余额变化
+	Profit      string    // 分润值变化
+	Nonce       int64     // nonce变化
+	EndTime     time.Time // 变化前的EndTime
+}
+
+func (c *ProfitChange) CreateProfitChangeTx(tx *gorm.DB) error {
+	if c.Balance == "" {
+		c.Balance = "0"
+	}
+	if c.Profit == "" {
+		c.Profit = "0"
+	}
+	return tx.Create(c).Error
+}
+
+// revertProfitChange applies the inverse of the change to the profit
+func revertProfitChange(tx *gorm.DB, change ProfitChange) error {
+	if change.Created {
+		return tx.Where("address = ?", change.Address).Delete(&ProfitStore{}).Error
+	}
+
+	var profitStore ProfitStore
+	err := tx.Model(&ProfitStore{}).Where("address = ?", change.Address).First(&profitStore).Error
+	if err != nil {
+		return err
+	}
+
+	balance, err := subDecimal(profitStore.Balance, change.Balance)
+	if err != nil {
+		return err
+	}
+	profit, err := subDecimal(profitStore.Profit, change.Profit)
+	if err != nil {
+		return err
+	}
+
+	profitStore.Balance = balance
+	profitStore.Profit = profit
+	profitStore.Nonce = uint64(int64(profitStore.Nonce) - change.Nonce)
+	if !change.EndTime.IsZero() {
+		profitStore.EndTime = change.EndTime
+	}
+	return tx.Save(&profitStore).Error
+}
+
+func subDecimal(a, b string) (string, error) {
+	x, ok := new(big.Int).SetString(a, 10)
+	if !ok {
+		return "", xerrors.Errorf("%s is not in decimal format", a)
+	}
+	y, ok := new(big.Int).SetString(b, 10)
+	if !ok {
+		return "", xerrors.Errorf("%s is not in decimal format", b)
+	}
+	return x.Sub(x, y).String(), nil
+}
+
 var blockNumberKey = "block_number_key"
 
 type BlockNumber struct {
@@ -4,6 +4,7 @@ import (
 	"math/big"
 
 	"golang.org/x/xerrors"
+	"gorm.io/gorm"
 )
 
 type Provider struct {
@@ -12,6 +13,8 @@ type Provider struct {
 	IP      string
 	Domain  string
 	Port    string
+
+	BlockNumber uint64 `gorm:"index"` // 注册事件所在区块
 }
 
 func InitProvider() error {
@@ -19,7 +22,11 @@ func InitProvider() error {
 }
 
 func (p *Provider) CreateProvider() error {
-	return GlobalDataBase.Create(p).Error
+	return p.CreateProviderTx(GlobalDataBase)
+}
+
+func (p *Provider) CreateProviderTx(tx *gorm.DB) error {
+	return tx.Create(p).Error
 }
 
 func GetProviderByAddress(address string) (Provider, error) {
@@ -47,11 +54,13 @@ type Node struct {
 
 	DiskPrice    *big.Int
 	DiskCapacity int64
+
+	BlockNumber uint64
 }
 
 type NodeStore struct {
 	Address string `gorm:"primaryKey"`
-	Id      int    `gorm:"primaryKey"`
+	Id      int    `gorm:"primaryKey;autoIncrement:false"`
 
 	CPUPrice string
 	CPUModel string
@@ -64,6 +73,15 @@ type NodeStore struct {
 
 	DiskPrice    string
 	DiskCapacity int64
+
+	BlockNumber uint64 `gorm:"index"`
+}
+
+// Price returns the sum of the per second prices of the node
+func (n *Node) Price() *big.Int {
+	price := new(big.Int).Add(n.CPUPrice, n.GPUPrice)
+	price.Add(price, n.MemPrice)
+	return price.Add(price, n.DiskPrice)
 }
 
 func InitNode() error {
@@ -71,16 +89,24 @@ func InitNode() error {
 }
 
 func (n *Node) CreateNode() error {
+	return n.CreateNodeTx(GlobalDataBase)
+}
+
+func (n *Node) CreateNodeTx(tx *gorm.DB) error {
 	nodeStore, err := NodeToNodeStore(*n)
 	if err != nil {
 		return err
 	}
-	return GlobalDataBase.Create(&nodeStore).Error
+	return tx.Create(&nodeStore).Error
 }
 
 func GetNodeByAddressAndId(address string, id int) (Node, error) {
+	return GetNodeByAddressAndIdTx(GlobalDataBase, address, id)
+}
+
+func GetNodeByAddressAndIdTx(tx *gorm.DB, address string, id int) (Node, error) {
 	var nodeStore NodeStore
-	err := GlobalDataBase.Model(&NodeStore{}).Where("address = ? AND id = ?", address, id).First(&nodeStore).Error
+	err := tx.Model(&NodeStore{}).Where("address = ? AND id = ?", address, id).First(&nodeStore).Error
 	if err != nil {
 		return Node{}, err
 	}
@@ -104,6 +130,8 @@ func NodeToNodeStore(node Node) (NodeStore, error) {
 
 		DiskPrice:    node.DiskPrice.String(),
 		DiskCapacity: node.DiskCapacity,
+
+		BlockNumber: node.BlockNumber,
 	}, nil
 }
 
@@ -143,5 +171,7 @@ func NodeStoreToNode(node NodeStore) (Node, error) {
 
 		DiskPrice:    diskPrice,
 		DiskCapacity: node.DiskCapacity,
+
+		BlockNumber: node.BlockNumber,
 	}, nil
 }
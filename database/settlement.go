@@ -0,0 +1,45 @@
+package database
+
+import "gorm.io/gorm"
+
+// OrderSettlement records how an order was settled in a round
+type OrderSettlement struct {
+	Id      uint   `gorm:"primaryKey"`
+	Round   int64  `gorm:"index"`
+	Address string `gorm:"index"`
+	NodeId  int
+	OrderId uint64
+	Success bool   // 节点本轮是否提交了证明
+	Reward  string // 释放到余额的分润值
+	Penalty string // 惩罚值
+}
+
+func InitOrderSettlement() error {
+	return GlobalDataBase.AutoMigrate(&OrderSettlement{})
+}
+
+func (s *OrderSettlement) CreateOrderSettlementTx(tx *gorm.DB) error {
+	return tx.Create(s).Error
+}
+
+// IsProviderSettledTx reports whether the orders of the provider are already
+// settled in the round
+func IsProviderSettledTx(tx *gorm.DB, round int64, address string) (bool, error) {
+	var count int64
+	err := tx.Model(&OrderSettlement{}).Where("round = ? AND address = ?", round, address).Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func ListOrderSettlementsByRoundTx(tx *gorm.DB, round int64) ([]OrderSettlement, error) {
+	var settlements []OrderSettlement
+	err := tx.Model(&OrderSettlement{}).Where("round = ?", round).Order("address, node_id, order_id").Find(&settlements).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return settlements, nil
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"math/big"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	WithdrawalPending    = "pending"    // 已签名, 未在链上取出
+	WithdrawalCompleted  = "completed"  // 已在链上取出
+	WithdrawalSuperseded = "superseded" // 同一nonce的其他签名已被使用
+)
+
+type Withdrawal struct {
+	Id        uint   `gorm:"primaryKey"`
+	Address   string `gorm:"index"`
+	Amount    string
+	Nonce     uint64
+	Signature string    // 为空表示链上事件没有对应的签名记录
+	IssueTime time.Time // 签名时间
+	Status    string
+
+	TxHash       string
+	BlockNumber  uint64 `gorm:"index"`
+	CompleteTime time.Time
+}
+
+func InitWithdrawal() error {
+	return GlobalDataBase.AutoMigrate(&Withdrawal{})
+}
+
+func (w *Withdrawal) CreateWithdrawalTx(tx *gorm.DB) error {
+	return tx.Create(w).Error
+}
+
+func GetPendingWithdrawalTx(tx *gorm.DB, address string, nonce uint64) (Withdrawal, error) {
+	var withdrawal Withdrawal
+	err := tx.Model(&Withdrawal{}).Where("address = ? AND nonce = ? AND status = ?", address, nonce, WithdrawalPending).First(&withdrawal).Error
+	if err != nil {
+		return Withdrawal{}, err
+	}
+
+	return withdrawal, nil
+}
+
+func ListWithdrawalsByAddressTx(tx *gorm.DB, address string, status string) ([]Withdrawal, error) {
+	var withdrawals []Withdrawal
+	err := tx.Model(&Withdrawal{}).Where("address = ? AND status = ?", address, status).Order("id desc").Find(&withdrawals).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return withdrawals, nil
+}
+
+// CompleteWithdrawalTx reconciles a Withdraw event with the signatures issued
+// for the nonce. The signature with the same amount is completed and the others
+// can not be used any more, an event without a signature is recorded as well.
+func CompleteWithdrawalTx(tx *gorm.DB, address string, amount *big.Int, nonce uint64, txHash string, blockNumber uint64, now time.Time) error {
+	var withdrawals []Withdrawal
+	err := tx.Model(&Withdrawal{}).Where("address = ? AND nonce = ? AND status = ?", address, nonce, WithdrawalPending).Order("id").Find(&withdrawals).Error
+	if err != nil {
+		return err
+	}
+
+	var matched bool
+	for _, withdrawal := range withdrawals {
+		withdrawal.BlockNumber = blockNumber
+		if !matched && withdrawal.Amount == amount.String() {
+			matched = true
+			withdrawal.Status = WithdrawalCompleted
+			withdrawal.TxHash = txHash
+			withdrawal.CompleteTime = now
+		} else {
+			withdrawal.Status = WithdrawalSuperseded
+		}
+
+		err = tx.Save(&withdrawal).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if matched {
+		return nil
+	}
+
+	logger.Warnf("Withdraw of %s at nonce %d has no issued signature", address, nonce)
+	return tx.Create(&Withdrawal{
+		Address:      address,
+		Amount:       amount.String(),
+		Nonce:        nonce,
+		Status:       WithdrawalCompleted,
+		TxHash:       txHash,
+		BlockNumber:  blockNumber,
+		CompleteTime: now,
+	}).Error
+}
+
+// rollbackWithdrawals makes the signatures reconciled in orphaned blocks pending again
+func rollbackWithdrawals(tx *gorm.DB, number uint64) error {
+	err := tx.Where("block_number >= ? AND signature = ?", number, "").Delete(&Withdrawal{}).Error
+	if err != nil {
+		return err
+	}
+
+	return tx.Model(&Withdrawal{}).Where("block_number >= ?", number).Updates(map[string]interface{}{
+		"status":        WithdrawalPending,
+		"tx_hash":       "",
+		"block_number":  0,
+		"complete_time": time.Time{},
+	}).Error
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCompleteWithdrawal(t *testing.T) {
+	const address = "0x01"
+	now := time.Unix(1000, 0)
+
+	type ledger struct {
+		amount string
+		signed bool
+		status string
+	}
+	tests := []struct {
+		name    string
+		pending []string // amounts signed for the nonce, oldest first
+		amount  int64
+		want    []ledger
+	}{
+		{"signed amount", []string{"600"}, 600, []ledger{{"600", true, WithdrawalCompleted}}},
+		{"other amount", []string{"600"}, 500, []ledger{{"600", true, WithdrawalSuperseded}, {"500", false, WithdrawalCompleted}}},
+		{"reissued amount", []string{"600", "500"}, 500, []ledger{{"600", true, WithdrawalSuperseded}, {"500", true, WithdrawalCompleted}}},
+		{"same amount twice", []string{"600", "600"}, 600, []ledger{{"600", true, WithdrawalCompleted}, {"600", true, WithdrawalSuperseded}}},
+		{"without signature", nil, 600, []ledger{{"600", false, WithdrawalCompleted}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := OpenDatabase(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, amount := range tt.pending {
+				withdrawal := Withdrawal{
+					Address:   address,
+					Amount:    amount,
+					Nonce:     3,
+					Signature: "signature of " + amount,
+					IssueTime: now,
+					Status:    WithdrawalPending,
+				}
+				err = withdrawal.CreateWithdrawalTx(db)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = CompleteWithdrawalTx(db, address, big.NewInt(tt.amount), 3, "0xaa", 7, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var withdrawals []Withdrawal
+			err = db.Model(&Withdrawal{}).Order("id").Find(&withdrawals).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(withdrawals) != len(tt.want) {
+				t.Fatalf("withdrawals %+v, want %+v", withdrawals, tt.want)
+			}
+			for i, withdrawal := range withdrawals {
+				want := tt.want[i]
+				got := ledger{withdrawal.Amount, withdrawal.Signature != "", withdrawal.Status}
+				if got != want {
+					t.Errorf("withdrawal %d is %+v, want %+v", i, got, want)
+				}
+				if withdrawal.BlockNumber != 7 {
+					t.Errorf("withdrawal %d reconciled at block %d", i, withdrawal.BlockNumber)
+				}
+				completed := withdrawal.Status == WithdrawalCompleted
+				if completed != (withdrawal.TxHash == "0xaa") || completed != withdrawal.CompleteTime.Equal(now) {
+					t.Errorf("withdrawal %d is %s with tx %q at %s", i, withdrawal.Status, withdrawal.TxHash, withdrawal.CompleteTime)
+				}
+			}
+
+			// a reorg of the block makes the signatures usable again
+			err = rollbackWithdrawals(db, 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			withdrawals = nil
+			err = db.Model(&Withdrawal{}).Order("id").Find(&withdrawals).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(withdrawals) != len(tt.pending) {
+				t.Fatalf("%d withdrawals after the rollback, want %d", len(withdrawals), len(tt.pending))
+			}
+			for i, withdrawal := range withdrawals {
+				if withdrawal.Amount != tt.pending[i] || withdrawal.Status != WithdrawalPending || withdrawal.TxHash != "" || withdrawal.BlockNumber != 0 {
+					t.Errorf("withdrawal %d after the rollback %+v", i, withdrawal)
+				}
+			}
+		})
+	}
+}
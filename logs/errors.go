@@ -124,6 +124,38 @@ func (e WalletError) Error() string {
 	return e.Message
 }
 
+type BalanceError struct {
+	Message string
+}
+
+func (e BalanceError) Error() string {
+	return e.Message
+}
+
+type ConflictError struct {
+	Message string
+}
+
+func (e ConflictError) Error() string {
+	return e.Message
+}
+
+type RoundError struct {
+	Message string
+}
+
+func (e RoundError) Error() string {
+	return e.Message
+}
+
+type StandbyError struct {
+	Message string
+}
+
+func (e StandbyError) Error() string {
+	return e.Message
+}
+
 type APIError struct {
 	Code           string
 	Description    string
@@ -152,6 +184,10 @@ const (
 	ErrController
 	ErrNoPermission
 	ErrWallet
+	ErrBalance
+	ErrConflict
+	ErrRound
+	ErrStandby
 )
 
 func (e errorCodeMap) ToAPIErrWithErr(errCode APIErrorCode, err error) APIError {
@@ -250,6 +286,26 @@ var ErrorCodes = errorCodeMap{
 		Description:    "datastore error",
 		HTTPStatusCode: 528,
 	},
+	ErrBalance: {
+		Code:           "Balance",
+		Description:    "Insufficient balance",
+		HTTPStatusCode: 529,
+	},
+	ErrConflict: {
+		Code:           "Conflict",
+		Description:    "The request conflicts with the current state",
+		HTTPStatusCode: http.StatusConflict,
+	},
+	ErrRound: {
+		Code:           "WrongRound",
+		Description:    "The proof is not for the current round",
+		HTTPStatusCode: 530,
+	},
+	ErrStandby: {
+		Code:           "Standby",
+		Description:    "The validator is standby, retry on the leader",
+		HTTPStatusCode: http.StatusServiceUnavailable,
+	},
 }
 
 func ToAPIErrorCode(err error) APIError {
@@ -289,6 +345,14 @@ func ToAPIErrorCode(err error) APIError {
 		apiErr = ErrWallet
 	case *DataStoreError:
 		apiErr = ErrDataStore
+	case BalanceError:
+		apiErr = ErrBalance
+	case ConflictError:
+		apiErr = ErrConflict
+	case RoundError:
+		apiErr = ErrRound
+	case StandbyError:
+		apiErr = ErrStandby
 	default:
 		apiErr = ErrInternal
 	}
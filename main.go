@@ -10,7 +10,7 @@ import (
 
 func main() {
 	local := make([]*cli.Command, 0, 1)
-	local = append(local, cmd.ValidatorCmd, cmd.VersionCmd)
+	local = append(local, cmd.ValidatorCmd, cmd.ProverCmd, cmd.VersionCmd)
 	app := cli.App{
 		Commands: local,
 		Flags: []cli.Flag{